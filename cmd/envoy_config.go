@@ -1,101 +1,339 @@
 package main
 
 import (
-	"context"
 	"flag"
 	"fmt"
 	"github.com/envoyproxy/go-control-plane/envoy/api/v2"
-	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
-	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v2"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
-	"github.com/gogo/protobuf/proto"
 	"github.com/luguoxiang/envoy-demo/pkg/client"
 	"github.com/luguoxiang/envoy-demo/pkg/envoy"
-	"google.golang.org/grpc"
+	"github.com/luguoxiang/envoy-demo/pkg/kubernetes"
 )
 
-type StreamClient interface {
-	Send(*v2.DiscoveryRequest) error
-	Recv() (*v2.DiscoveryResponse, error)
-}
-
-type StreamFunction func(cc *grpc.ClientConn) (StreamClient, error)
-
 func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "diff":
+			os.Exit(diffMain(os.Args[2:]))
+		case "dump":
+			os.Exit(dumpMain(os.Args[2:]))
+		case "simulate":
+			os.Exit(simulateMain(os.Args[2:]))
+		case "validate":
+			os.Exit(validateMain(os.Args[2:]))
+		case "loadtest":
+			os.Exit(loadtestMain(os.Args[2:]))
+		case "bootstrap":
+			os.Exit(bootstrapMain(os.Args[2:]))
+		}
+	}
+
 	var serverAddr string
 	var typeUrl string
 	var nodeId string
 	var resource string
+	var watch bool
+	var output string
 	flag.StringVar(&serverAddr, "serverAddr", "localhost:15010", "grpc server address")
 	flag.StringVar(&nodeId, "nodeId", "", "nodeId")
 	flag.StringVar(&resource, "resource", "", "resource")
-	urls := []string{
-		envoy.ListenerResource,
-		envoy.ClusterResource,
-		envoy.RouteResource,
-		envoy.EndpointResource,
-	}
+	flag.BoolVar(&watch, "watch", false, "keep the stream open and print the changes of every push, all types are watched unless typeUrl is given")
+
+	flag.StringVar(&output, "output", client.OUTPUT_YAML, fmt.Sprintf("one of %v", client.OutputFormats))
 
-	flag.StringVar(&typeUrl, "typeUrl", envoy.ListenerResource, fmt.Sprintf("one of %v", urls))
+	flag.StringVar(&typeUrl, "typeUrl", envoy.ListenerResource, fmt.Sprintf("one of %v", client.ResourceTypes))
 	flag.Parse()
-	fmt.Printf("connecting %s\n", serverAddr)
-	conn, err := grpc.Dial(serverAddr, grpc.WithInsecure())
+	if !client.ValidOutput(output) {
+		fmt.Fprintf(os.Stderr, "unknown output %s, expect one of %v\n", output, client.OutputFormats)
+		os.Exit(2)
+	}
+	//status messages go to stderr so that stdout can be parsed
+	fmt.Fprintf(os.Stderr, "connecting %s\n", serverAddr)
+	xdsClient, err := client.NewXdsClient(serverAddr, nodeId)
 	if err != nil {
 		panic(err)
 	}
-	defer conn.Close()
-	fmt.Println("connected")
-	ctx := context.Background()
+	defer xdsClient.Close()
+	fmt.Fprintln(os.Stderr, "connected")
 
-	ads, err := discovery.NewAggregatedDiscoveryServiceClient(conn).StreamAggregatedResources(ctx)
+	var resourceNames []string
+	if resource != "" {
+		resourceNames = []string{resource}
+	}
+
+	if watch {
+		typeUrls := client.ResourceTypes
+		flag.Visit(func(f *flag.Flag) {
+			if f.Name == "typeUrl" {
+				typeUrls = []string{typeUrl}
+			}
+		})
+		err = watchResources(xdsClient, typeUrls, resourceNames, output)
+	} else {
+		err = printResources(xdsClient, typeUrl, resourceNames, output)
+	}
 	if err != nil {
-		panic(err)
+		fmt.Fprintln(os.Stderr, err.Error())
+		os.Exit(1)
+	}
+}
+
+func printResources(xdsClient *client.XdsClient, typeUrl string, resourceNames []string, output string) error {
+	fmt.Fprintln(os.Stderr, "receiving")
+	response, err := xdsClient.Fetch(typeUrl, resourceNames)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(os.Stderr, "received")
+	resources, err := client.DecodeResources(response)
+	if err != nil {
+		return err
 	}
+	return client.Print(os.Stdout, resources, output)
+}
+
+func watchResources(xdsClient *client.XdsClient, typeUrls []string, resourceNames []string, output string) error {
+	//typeUrl -> resource name -> formatted resource of the last push
+	current := make(map[string]map[string]string)
+	return xdsClient.Watch(typeUrls, resourceNames, func(response *v2.DiscoveryResponse) error {
+		resources, err := client.DecodeResources(response)
+		if err != nil {
+			return err
+		}
+		next := make(map[string]string)
+		for _, resource := range resources {
+			text, err := client.Format(resource, output)
+			if err != nil {
+				return err
+			}
+			next[client.ResourceName(resource)] = text
+		}
+		header := fmt.Sprintf("%s %s version %s",
+			time.Now().Format(time.RFC3339), client.ShortTypeName(response.TypeUrl), response.VersionInfo)
+		client.PrintChanges(os.Stdout, header, client.DiffResources(current[response.TypeUrl], next))
+		current[response.TypeUrl] = next
+		return nil
+	})
+}
 
-	fmt.Println("client")
+func fetchNodeConfig(serverAddr string, nodeId string) (*client.NodeConfig, error) {
+	xdsClient, err := client.NewXdsClient(serverAddr, nodeId)
+	if err != nil {
+		return nil, err
+	}
+	defer xdsClient.Close()
+	return client.FetchNodeConfig(xdsClient)
+}
 
-	var request v2.DiscoveryRequest
-	request.TypeUrl = typeUrl
-	if resource != "" {
-		request.ResourceNames = []string{resource}
+// diffMain compares the configs two control planes serve to a node, it returns 1 if they differ
+// like diff(1) does.
+func diffMain(args []string) int {
+	flags := flag.NewFlagSet("diff", flag.ExitOnError)
+	serverAddr := flags.String("serverAddr", "localhost:15010", "grpc address of the first control plane")
+	otherAddr := flags.String("otherAddr", "", "grpc address of the second control plane")
+	nodeId := flags.String("nodeId", "", "nodeId")
+	otherNodeId := flags.String("otherNodeId", "", "nodeId on the second control plane, defaults to nodeId")
+	rules := flags.String("rules", "", "yaml file of name mapping rules")
+	flags.Parse(args)
+	if *otherAddr == "" {
+		fmt.Fprintln(os.Stderr, "otherAddr is required")
+		return 2
 	}
-	request.Node = &core.Node{Id: nodeId, Cluster: "httpbin"}
-	err = ads.Send(&request)
+	if *otherNodeId == "" {
+		*otherNodeId = *nodeId
+	}
+	mapper, err := client.LoadNameMapper(*rules)
 	if err != nil {
-		panic(err)
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 2
 	}
-	fmt.Println("receiving")
-	response, err := ads.Recv()
+	left, err := fetchNodeConfig(*serverAddr, *nodeId)
 	if err != nil {
-		panic(err)
+		fmt.Fprintf(os.Stderr, "failed to fetch from %s: %s\n", *serverAddr, err.Error())
+		return 2
 	}
-	fmt.Println("received")
-	for _, resource := range response.Resources {
-
-		if typeUrl == envoy.EndpointResource {
-			data := &v2.ClusterLoadAssignment{}
-			proto.Unmarshal(resource.Value, data)
-			fmt.Printf("------%s--------\n", data.ClusterName)
-			client.DoPrint(data)
-		} else if typeUrl == envoy.ClusterResource {
-			data := &v2.Cluster{}
-			proto.Unmarshal(resource.Value, data)
-			fmt.Printf("------%s--------\n", data.Name)
-			client.DoPrint(data)
-		} else if typeUrl == envoy.RouteResource {
-			data := &v2.RouteConfiguration{}
-			proto.Unmarshal(resource.Value, data)
-			fmt.Printf("------%s--------\n", data.Name)
-			client.DoPrint(data)
-		} else if typeUrl == envoy.ListenerResource {
-			data := &v2.Listener{}
-			proto.Unmarshal(resource.Value, data)
-			fmt.Printf("------%s--------\n", data.Name)
-			client.DoPrint(data)
-		} else {
-			panic("unknown type typeURL:" + typeUrl)
-		}
+	right, err := fetchNodeConfig(*otherAddr, *otherNodeId)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to fetch from %s: %s\n", *otherAddr, err.Error())
+		return 2
+	}
+	diff := &client.ConfigDiff{LeftName: *serverAddr, RightName: *otherAddr, Mapper: mapper}
+	differences := diff.Compare(left, right)
+	client.PrintDifferences(os.Stdout, differences)
+	if len(differences) > 0 {
+		return 1
+	}
+	return 0
+}
 
+// dumpMain fetches every resource of a node following the references between them like envoy,
+// and prints them as one config dump.
+func dumpMain(args []string) int {
+	flags := flag.NewFlagSet("dump", flag.ExitOnError)
+	serverAddr := flags.String("serverAddr", "localhost:15010", "grpc server address")
+	nodeId := flags.String("nodeId", "", "nodeId")
+	output := flags.String("output", client.OUTPUT_JSON, fmt.Sprintf("one of %v except %s", client.OutputFormats, client.OUTPUT_PROTO_TEXT))
+	flags.Parse(args)
+	if !client.ValidOutput(*output) || *output == client.OUTPUT_PROTO_TEXT {
+		fmt.Fprintf(os.Stderr, "unsupported output %s\n", *output)
+		return 2
 	}
+	config, err := fetchNodeConfig(*serverAddr, *nodeId)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to fetch from %s: %s\n", *serverAddr, err.Error())
+		return 1
+	}
+	if err := config.Dump(os.Stdout, *output); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	return 0
+}
+
+type headerFlags map[string]string
+
+func (headers headerFlags) String() string {
+	return fmt.Sprint(map[string]string(headers))
+}
+
+func (headers headerFlags) Set(value string) error {
+	index := strings.Index(value, ":")
+	if index <= 0 {
+		return fmt.Errorf("header %s is not name:value", value)
+	}
+	headers[strings.ToLower(strings.TrimSpace(value[:index]))] = strings.TrimSpace(value[index+1:])
+	return nil
+}
+
+// simulateMain explains which route, clusters and endpoints a request of a node would go to.
+func simulateMain(args []string) int {
+	flags := flag.NewFlagSet("simulate", flag.ExitOnError)
+	serverAddr := flags.String("serverAddr", "localhost:15010", "grpc server address")
+	nodeId := flags.String("nodeId", "", "nodeId")
+	destination := flags.String("host", "", "destination host:port of the request")
+	path := flags.String("path", "/", "request path")
+	method := flags.String("method", "GET", "request method")
+	headers := headerFlags{}
+	flags.Var(headers, "header", "request header name:value, may be repeated")
+	flags.Parse(args)
 
+	host, portValue, err := net.SplitHostPort(*destination)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid host %q: %s\n", *destination, err.Error())
+		return 2
+	}
+	port, err := strconv.ParseUint(portValue, 10, 32)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "invalid port %q\n", portValue)
+		return 2
+	}
+	config, err := fetchNodeConfig(*serverAddr, *nodeId)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to fetch from %s: %s\n", *serverAddr, err.Error())
+		return 1
+	}
+	simulation := &client.Simulation{Config: config, Out: os.Stdout}
+	err = simulation.Run(&client.SimulatedRequest{
+		Host:    host,
+		Port:    uint32(port),
+		Path:    *path,
+		Method:  strings.ToUpper(*method),
+		Headers: headers,
+	})
+	if err != nil {
+		fmt.Println(err.Error())
+		return 1
+	}
+	return 0
+}
+
+// validateMain checks the config of a node, it returns 1 if any problem is found.
+func validateMain(args []string) int {
+	flags := flag.NewFlagSet("validate", flag.ExitOnError)
+	serverAddr := flags.String("serverAddr", "localhost:15010", "grpc server address")
+	nodeId := flags.String("nodeId", "", "nodeId")
+	flags.Parse(args)
+	config, err := fetchNodeConfig(*serverAddr, *nodeId)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to fetch from %s: %s\n", *serverAddr, err.Error())
+		return 2
+	}
+	result := config.Validate()
+	for _, err := range result.Errors {
+		fmt.Printf("error: %s\n", err)
+	}
+	for _, warning := range result.Warnings {
+		fmt.Printf("warning: %s\n", warning)
+	}
+	fmt.Printf("%d errors, %d warnings\n", len(result.Errors), len(result.Warnings))
+	if len(result.Errors) > 0 || len(result.Warnings) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// loadtestMain measures how pushes of an in-process control plane reach many fake nodes.
+func loadtestMain(args []string) int {
+	flags := flag.NewFlagSet("loadtest", flag.ExitOnError)
+	test := &client.LoadTest{Out: os.Stdout}
+	flags.IntVar(&test.Nodes, "nodes", 100, "number of fake envoy nodes, each one with its own pod")
+	flags.IntVar(&test.Mutations, "mutations", 10, "number of pod mutations")
+	flags.DurationVar(&test.Interval, "interval", 2*time.Second, "time between mutations")
+	flags.DurationVar(&test.Settle, "settle", 10*time.Second, "time waited after the last mutation")
+	flags.Parse(args)
+	if test.Nodes <= 0 {
+		fmt.Fprintln(os.Stderr, "nodes must be positive")
+		return 2
+	}
+	if err := test.Run(); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	return 0
+}
+
+// bootstrapMain prints the envoy bootstrap of a node, with -static the current config of the node
+// is inlined so that envoy runs without the control plane.
+func bootstrapMain(args []string) int {
+	flags := flag.NewFlagSet("bootstrap", flag.ExitOnError)
+	options := &client.BootstrapOptions{}
+	flags.StringVar(&options.NodeId, "nodeId", "", "nodeId, the pod name")
+	flags.StringVar(&options.Cluster, "cluster", "", "service cluster, the app of the pod")
+	flags.StringVar(&options.AdminAddress, "adminAddress", "0.0.0.0", "address of the envoy admin listener")
+	meshConfigFile := flags.String("meshConfig", "", "mesh config yaml file, the defaults are used if empty")
+	static := flags.Bool("static", false, "inline the listeners, clusters, routes and endpoints the server sends to the node")
+	serverAddr := flags.String("serverAddr", "localhost:15010", "grpc server address, used with -static")
+	output := flags.String("output", client.OUTPUT_YAML, fmt.Sprintf("%s or %s", client.OUTPUT_JSON, client.OUTPUT_YAML))
+	flags.Parse(args)
+	if options.NodeId == "" || options.Cluster == "" {
+		fmt.Fprintln(os.Stderr, "nodeId and cluster are required")
+		return 2
+	}
+	if *output != client.OUTPUT_JSON && *output != client.OUTPUT_YAML {
+		fmt.Fprintf(os.Stderr, "unsupported output %s\n", *output)
+		return 2
+	}
+	if _, err := kubernetes.NewMeshConfigLoader(*meshConfigFile, nil).Load(); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to load mesh config %s: %s\n", *meshConfigFile, err.Error())
+		return 2
+	}
+	options.Mesh = kubernetes.GetMeshConfig()
+	if *static {
+		config, err := fetchNodeConfig(*serverAddr, options.NodeId)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to fetch from %s: %s\n", *serverAddr, err.Error())
+			return 1
+		}
+		options.Static = config
+	}
+	if err := client.WriteBootstrap(os.Stdout, options, *output); err != nil {
+		fmt.Fprintln(os.Stderr, err.Error())
+		return 1
+	}
+	return 0
 }
@@ -5,51 +5,157 @@ import (
 	"flag"
 	"fmt"
 	//"github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	accesslog "github.com/envoyproxy/go-control-plane/envoy/service/accesslog/v2"
 	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v2"
 	"github.com/golang/glog"
 	"github.com/luguoxiang/envoy-demo/pkg/envoy"
 	"github.com/luguoxiang/envoy-demo/pkg/kubernetes"
 	"google.golang.org/grpc"
 	"net"
+	"net/http"
+	"time"
 )
 
 const grpcMaxConcurrentStreams = 1000000
 
 func main() {
+	var meshConfigFile string
+	var accessLogFile string
+	var accessLogBufferSize int
+	var appNamespace, controlPlaneService, zipkinService, outboundTrafficPolicy string
+	var controlPlanePort, proxyListenPort, proxyManagePort, zipkinPort uint
+	var proxyUID int64
+	var connectTimeout time.Duration
+	var registryType, registryFile, kubeconfig string
+	flag.StringVar(&meshConfigFile, "meshConfig", "", "mesh config yaml file, reloaded on change")
+	flag.StringVar(&accessLogFile, "accessLogFile", "", "file to append received access logs as json lines")
+	flag.IntVar(&accessLogBufferSize, "accessLogBufferSize", 100, "access logs kept in memory for each source and destination")
+	//the flags below override the mesh config file
+	flag.StringVar(&appNamespace, "appNamespace", "", "namespace of the mesh apps")
+	flag.StringVar(&controlPlaneService, "controlPlaneService", "", "service name of the control plane")
+	flag.UintVar(&controlPlanePort, "controlPlanePort", 0, "grpc port of the control plane")
+	flag.UintVar(&proxyListenPort, "proxyListenPort", 0, "port envoy listens for redirected traffic")
+	flag.UintVar(&proxyManagePort, "proxyManagePort", 0, "envoy admin port")
+	flag.Int64Var(&proxyUID, "proxyUID", 0, "uid envoy runs as")
+	flag.DurationVar(&connectTimeout, "connectTimeout", 0, "connect timeout of clusters")
+	flag.StringVar(&zipkinService, "zipkinService", "", "tracing collector service")
+	flag.UintVar(&zipkinPort, "zipkinPort", 0, "tracing collector port")
+	flag.StringVar(&outboundTrafficPolicy, "outboundTrafficPolicy", "", "ALLOW_ANY or REGISTRY_ONLY")
+	flag.StringVar(&registryType, "registry", kubernetes.REGISTRY_KUBERNETES,
+		fmt.Sprintf("source of pods, %s or %s", kubernetes.REGISTRY_KUBERNETES, kubernetes.REGISTRY_FILE))
+	flag.StringVar(&registryFile, "registryFile", "", "yaml or json file of services and endpoints for the file registry, reloaded on change")
+	flag.StringVar(&kubeconfig, "kubeconfig", "", "kubeconfig file to run outside of the cluster, the in-cluster config is used if empty")
 	flag.Parse()
 
+	setFlags := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) {
+		setFlags[f.Name] = true
+	})
+	loader := kubernetes.NewMeshConfigLoader(meshConfigFile, func(config *kubernetes.MeshConfig) {
+		if setFlags["appNamespace"] {
+			config.AppNamespace = appNamespace
+		}
+		if setFlags["controlPlaneService"] {
+			config.ControlPlane.Service = controlPlaneService
+		}
+		if setFlags["controlPlanePort"] {
+			config.ControlPlane.Port = uint32(controlPlanePort)
+		}
+		if setFlags["proxyListenPort"] {
+			config.Proxy.ListenPort = uint32(proxyListenPort)
+		}
+		if setFlags["proxyManagePort"] {
+			config.Proxy.ManagePort = uint32(proxyManagePort)
+		}
+		if setFlags["proxyUID"] {
+			config.Proxy.UID = proxyUID
+		}
+		if setFlags["connectTimeout"] {
+			config.ConnectTimeout = connectTimeout
+		}
+		if setFlags["zipkinService"] {
+			config.Tracing.Service = zipkinService
+		}
+		if setFlags["zipkinPort"] {
+			config.Tracing.Port = uint32(zipkinPort)
+		}
+		if setFlags["outboundTrafficPolicy"] {
+			config.OutboundTrafficPolicy = outboundTrafficPolicy
+		}
+	})
+	if _, err := loader.Load(); err != nil {
+		glog.Fatalf("failed to load mesh config %s:%s", meshConfigFile, err.Error())
+		panic(err.Error())
+	}
+	controlPlanePort = uint(kubernetes.GetMeshConfig().ControlPlane.Port)
+
 	ctx := context.Background()
 
 	grpcServer := grpc.NewServer(
 		grpc.MaxConcurrentStreams(grpcMaxConcurrentStreams))
 
-	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", kubernetes.CONTROL_PLANE_PORT))
+	lis, err := net.Listen("tcp", fmt.Sprintf(":%d", controlPlanePort))
 	if err != nil {
-		glog.Fatalf("failed to listen %d:%s", kubernetes.CONTROL_PLANE_PORT, err.Error())
+		glog.Fatalf("failed to listen %d:%s", controlPlanePort, err.Error())
 		panic(err.Error())
 	}
 
-	k8sManager, err := kubernetes.NewK8sResourceManager()
-	if err != nil {
-		glog.Fatalf("failed to create  K8sResourceManager:%s", err.Error())
-		panic(err.Error())
+	var registry kubernetes.Registry
+	var k8sManager *kubernetes.K8sResourceManager
+	//the file registry runs without kubernetes unless a kubeconfig is given
+	if registryType == kubernetes.REGISTRY_KUBERNETES || kubeconfig != "" {
+		k8sManager, err = kubernetes.NewK8sResourceManager(kubeconfig)
+		if err != nil {
+			glog.Fatalf("failed to create  K8sResourceManager:%s", err.Error())
+			panic(err.Error())
+		}
+	}
+	switch registryType {
+	case kubernetes.REGISTRY_KUBERNETES:
+		registry = k8sManager
+	case kubernetes.REGISTRY_FILE:
+		if registryFile == "" {
+			glog.Fatalf("registryFile is required by the %s registry", kubernetes.REGISTRY_FILE)
+		}
+		registry = kubernetes.NewFileRegistry(registryFile)
+	default:
+		glog.Fatalf("unknown registry %s", registryType)
 	}
 
 	cds := envoy.NewClustersDiscoveryService()
 	eds := envoy.NewEndpointsDiscoveryService()
 	lds := envoy.NewListenersDiscoveryService()
-	rds := envoy.NewRoutesDiscoveryService(k8sManager)
+	rds := envoy.NewRoutesDiscoveryService()
 
 	ads := envoy.NewAggregatedDiscoveryService(cds, eds, lds, rds)
 	stopper := make(chan struct{})
-	go k8sManager.WatchPods(stopper, cds, eds, lds)
+	go registry.WatchPods(stopper, cds, eds, lds)
+	if k8sManager != nil {
+		go k8sManager.WatchServices(stopper, rds)
+		go k8sManager.WatchServiceEntries(stopper, cds, lds, rds)
+		go k8sManager.WatchTrafficSplits(stopper, cds, eds, rds)
+		go kubernetes.NewCanaryController(k8sManager).Run(stopper)
+	} else {
+		glog.Info("running without kubernetes, service entries, traffic splits, canaries and the webhook are disabled")
+	}
+	go loader.Watch(stopper, cds, eds, lds, rds)
 
 	//v2.RegisterEndpointDiscoveryServiceServer(grpcServer, eds)
 	//v2.RegisterClusterDiscoveryServiceServer(grpcServer, cds)
 	//v2.RegisterListenerDiscoveryServiceServer(grpcServer, lds)
 	//v2.RegisterRouteDiscoveryServiceServer(grpcServer, rds)
 	discovery.RegisterAggregatedDiscoveryServiceServer(grpcServer, ads)
-	glog.Infof("grpc server listening %s", kubernetes.CONTROL_PLANE_PORT)
+
+	als, err := envoy.NewAccessLogService(accessLogBufferSize, accessLogFile)
+	if err != nil {
+		glog.Fatalf("failed to create AccessLogService:%s", err.Error())
+		panic(err.Error())
+	}
+	if k8sManager != nil {
+		als.SetPeers(k8sManager.ControlPlanePeers)
+	}
+	accesslog.RegisterAccessLogServiceServer(grpcServer, als)
+	glog.Infof("grpc server listening %d", controlPlanePort)
 
 	go func() {
 		if err = grpcServer.Serve(lis); err != nil {
@@ -57,8 +163,22 @@ func main() {
 		}
 	}()
 
-	webhookServer := kubernetes.NewWebhookServer()
-	go webhookServer.Run()
+	if k8sManager != nil {
+		webhookServer := kubernetes.NewWebhookServer(k8sManager)
+		go webhookServer.WatchSidecarTemplate(stopper)
+		go webhookServer.RotateCertificates(stopper)
+		go webhookServer.Run()
+	}
+
+	debugMux := http.NewServeMux()
+	debugMux.Handle("/accesslogs", als)
+	debugMux.Handle("/ready", ads.Nodes)
+	go func() {
+		glog.Infof("debug server listening %d", kubernetes.DEBUG_PORT)
+		if err := http.ListenAndServe(fmt.Sprintf(":%d", kubernetes.DEBUG_PORT), debugMux); err != nil {
+			glog.Error(err)
+		}
+	}()
 
 	<-ctx.Done()
 
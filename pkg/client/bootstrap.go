@@ -0,0 +1,269 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/listener"
+	hcm "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/http_connection_manager/v2"
+	"github.com/gogo/protobuf/proto"
+	"github.com/gogo/protobuf/types"
+	"github.com/luguoxiang/envoy-demo/pkg/envoy"
+	"github.com/luguoxiang/envoy-demo/pkg/kubernetes"
+)
+
+const (
+	XDS_CLUSTER      = "xds_cluster"
+	TRACING_CLUSTER  = "tracing_collector"
+	ZIPKIN_TRACER    = "envoy.zipkin"
+	ADMIN_ACCESS_LOG = "/dev/null"
+)
+
+// BootstrapOptions describes the envoy node a bootstrap is generated for.
+type BootstrapOptions struct {
+	NodeId string
+	//service cluster of the node, the app of the pod
+	Cluster      string
+	AdminAddress string
+	Mesh         *kubernetes.MeshConfig
+	//resources inlined as static resources instead of being fetched from the control plane, may be nil
+	Static *NodeConfig
+}
+
+type bootstrapAdmin struct {
+	AccessLogPath string          `json:"access_log_path"`
+	Address       json.RawMessage `json:"address"`
+}
+
+type bootstrapStaticResources struct {
+	Listeners []json.RawMessage `json:"listeners,omitempty"`
+	Clusters  []json.RawMessage `json:"clusters,omitempty"`
+}
+
+type bootstrapDynamicResources struct {
+	LdsConfig json.RawMessage `json:"lds_config"`
+	CdsConfig json.RawMessage `json:"cds_config"`
+	AdsConfig json.RawMessage `json:"ads_config"`
+}
+
+type bootstrapTracer struct {
+	Name   string            `json:"name"`
+	Config map[string]string `json:"config"`
+}
+
+type bootstrapTracing struct {
+	Http *bootstrapTracer `json:"http"`
+}
+
+type bootstrapConfig struct {
+	Node             json.RawMessage            `json:"node"`
+	Admin            *bootstrapAdmin            `json:"admin"`
+	StaticResources  *bootstrapStaticResources  `json:"static_resources"`
+	DynamicResources *bootstrapDynamicResources `json:"dynamic_resources,omitempty"`
+	Tracing          *bootstrapTracing          `json:"tracing,omitempty"`
+}
+
+func socketAddress(address string, port uint32) *core.Address {
+	return &core.Address{
+		Address: &core.Address_SocketAddress{
+			SocketAddress: &core.SocketAddress{
+				Protocol: core.TCP,
+				Address:  address,
+				PortSpecifier: &core.SocketAddress_PortValue{
+					PortValue: port,
+				},
+			},
+		},
+	}
+}
+
+func dnsCluster(name string, address string, port uint32, connectTimeout time.Duration) *v2.Cluster {
+	return &v2.Cluster{
+		Name:           name,
+		ConnectTimeout: connectTimeout,
+		ClusterDiscoveryType: &v2.Cluster_Type{
+			Type: v2.Cluster_STRICT_DNS,
+		},
+		DnsLookupFamily: v2.Cluster_V4_ONLY,
+		Hosts:           []*core.Address{socketAddress(address, port)},
+	}
+}
+
+// inlineRoutes returns a copy of l whose http connection managers embed their route configurations
+// instead of fetching them by RDS.
+func inlineRoutes(l *v2.Listener, routes map[string]*v2.RouteConfiguration) (*v2.Listener, error) {
+	result := proto.Clone(l).(*v2.Listener)
+	for i := range result.FilterChains {
+		chain := &result.FilterChains[i]
+		for j := range chain.Filters {
+			filter := &chain.Filters[j]
+			manager, err := decodeHttpConnectionManager(filter)
+			if err != nil {
+				return nil, fmt.Errorf("listener %s: %s", l.Name, err.Error())
+			}
+			if manager == nil {
+				continue
+			}
+			rds := manager.GetRds()
+			if rds == nil {
+				continue
+			}
+			config := routes[rds.RouteConfigName]
+			if config == nil {
+				return nil, fmt.Errorf("listener %s: route configuration %s was not served", l.Name, rds.RouteConfigName)
+			}
+			manager.RouteSpecifier = &hcm.HttpConnectionManager_RouteConfig{RouteConfig: config}
+			//keep the config in the form the control plane sent it
+			if _, ok := filter.ConfigType.(*listener.Filter_TypedConfig); ok {
+				typed, err := types.MarshalAny(manager)
+				if err != nil {
+					return nil, fmt.Errorf("listener %s: %s", l.Name, err.Error())
+				}
+				filter.ConfigType = &listener.Filter_TypedConfig{TypedConfig: typed}
+			} else {
+				pbs, err := envoy.MessageToStruct(manager)
+				if err != nil {
+					return nil, fmt.Errorf("listener %s: %s", l.Name, err.Error())
+				}
+				filter.ConfigType = &listener.Filter_Config{Config: pbs}
+			}
+		}
+	}
+	return result, nil
+}
+
+// inlineEndpoints returns a copy of cluster, EDS clusters are turned into static clusters with the
+// endpoints of their assignment.
+func inlineEndpoints(cluster *v2.Cluster, assignments map[string]*v2.ClusterLoadAssignment) *v2.Cluster {
+	result := proto.Clone(cluster).(*v2.Cluster)
+	if cluster.GetType() != v2.Cluster_EDS {
+		return result
+	}
+	assignment := &v2.ClusterLoadAssignment{}
+	if served := assignments[envoy.EndpointResourceName(cluster)]; served != nil {
+		assignment = proto.Clone(served).(*v2.ClusterLoadAssignment)
+	}
+	assignment.ClusterName = cluster.Name
+	result.ClusterDiscoveryType = &v2.Cluster_Type{Type: v2.Cluster_STATIC}
+	result.EdsClusterConfig = nil
+	result.LoadAssignment = assignment
+	return result
+}
+
+// StaticResources returns the listeners and clusters of config with their routes and endpoints inlined,
+// so that envoy runs with them without a control plane.
+func (config *NodeConfig) StaticResources() ([]*v2.Listener, []*v2.Cluster, error) {
+	routes := make(map[string]*v2.RouteConfiguration)
+	for _, route := range config.Routes {
+		routes[route.Name] = route
+	}
+	assignments := make(map[string]*v2.ClusterLoadAssignment)
+	for _, assignment := range config.Endpoints {
+		assignments[assignment.ClusterName] = assignment
+	}
+	var listeners []*v2.Listener
+	for _, l := range config.Listeners {
+		inlined, err := inlineRoutes(l, routes)
+		if err != nil {
+			return nil, nil, err
+		}
+		listeners = append(listeners, inlined)
+	}
+	var clusters []*v2.Cluster
+	for _, cluster := range config.Clusters {
+		clusters = append(clusters, inlineEndpoints(cluster, assignments))
+	}
+	return listeners, clusters, nil
+}
+
+// WriteBootstrap writes the envoy bootstrap of a node in json or yaml. Without static resources,
+// envoy gets its listeners and clusters by ADS from the control plane of the mesh config.
+func WriteBootstrap(w io.Writer, options *BootstrapOptions, output string) error {
+	if output != OUTPUT_JSON && output != OUTPUT_YAML {
+		return fmt.Errorf("output %s is not supported by bootstrap", output)
+	}
+	mesh := options.Mesh
+	var marshalErr error
+	marshal := func(message proto.Message) json.RawMessage {
+		//resources are written as the control plane sent them, Struct configs are not expanded
+		text, err := Format(message, OUTPUT_RAW)
+		if err != nil && marshalErr == nil {
+			marshalErr = err
+		}
+		return json.RawMessage(text)
+	}
+
+	bootstrap := &bootstrapConfig{
+		Node: marshal(&core.Node{Id: options.NodeId, Cluster: options.Cluster}),
+		Admin: &bootstrapAdmin{
+			AccessLogPath: ADMIN_ACCESS_LOG,
+			Address:       marshal(socketAddress(options.AdminAddress, mesh.Proxy.ManagePort)),
+		},
+		StaticResources: &bootstrapStaticResources{},
+	}
+	static := bootstrap.StaticResources
+	if options.Static != nil {
+		listeners, clusters, err := options.Static.StaticResources()
+		if err != nil {
+			return err
+		}
+		for _, l := range listeners {
+			static.Listeners = append(static.Listeners, marshal(l))
+		}
+		for _, cluster := range clusters {
+			static.Clusters = append(static.Clusters, marshal(cluster))
+		}
+	} else {
+		ads := &core.ConfigSource{
+			ConfigSourceSpecifier: &core.ConfigSource_Ads{
+				Ads: &core.AggregatedConfigSource{},
+			},
+		}
+		bootstrap.DynamicResources = &bootstrapDynamicResources{
+			LdsConfig: marshal(ads),
+			CdsConfig: marshal(ads),
+			AdsConfig: marshal(&core.ApiConfigSource{
+				ApiType: core.ApiConfigSource_GRPC,
+				GrpcServices: []*core.GrpcService{
+					&core.GrpcService{
+						TargetSpecifier: &core.GrpcService_EnvoyGrpc_{
+							EnvoyGrpc: &core.GrpcService_EnvoyGrpc{
+								ClusterName: XDS_CLUSTER,
+							},
+						},
+					},
+				},
+			}),
+		}
+		xdsCluster := dnsCluster(XDS_CLUSTER, mesh.ControlPlane.Service, mesh.ControlPlane.Port, mesh.ConnectTimeout)
+		xdsCluster.Http2ProtocolOptions = &core.Http2ProtocolOptions{}
+		static.Clusters = append(static.Clusters, marshal(xdsCluster))
+	}
+	//jaeger and opentelemetry collectors are reached through their zipkin compatible receivers
+	if mesh.Tracing.Enabled() {
+		bootstrap.Tracing = &bootstrapTracing{
+			Http: &bootstrapTracer{
+				Name: ZIPKIN_TRACER,
+				Config: map[string]string{
+					"collector_cluster":  TRACING_CLUSTER,
+					"collector_endpoint": mesh.Tracing.CollectorEndpoint(),
+				},
+			},
+		}
+		static.Clusters = append(static.Clusters,
+			marshal(dnsCluster(TRACING_CLUSTER, mesh.Tracing.Service, mesh.Tracing.Port, mesh.ConnectTimeout)))
+	}
+	if marshalErr != nil {
+		return marshalErr
+	}
+
+	data, err := json.Marshal(bootstrap)
+	if err != nil {
+		return err
+	}
+	return writeDocument(w, data, output)
+}
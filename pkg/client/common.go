@@ -2,54 +2,193 @@ package client
 
 import (
 	"fmt"
+	"io"
 	"strings"
 
-	"gopkg.in/yaml.v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/listener"
+	als "github.com/envoyproxy/go-control-plane/envoy/config/accesslog/v2"
+	accesslog "github.com/envoyproxy/go-control-plane/envoy/config/filter/accesslog/v2"
+	router "github.com/envoyproxy/go-control-plane/envoy/config/filter/http/router/v2"
+	hcm "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/http_connection_manager/v2"
+	tcp "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/tcp_proxy/v2"
+	"github.com/ghodss/yaml"
+	"github.com/gogo/protobuf/jsonpb"
+	"github.com/gogo/protobuf/proto"
+	"github.com/gogo/protobuf/types"
+	"github.com/luguoxiang/envoy-demo/pkg/envoy"
 )
 
-func doClean(in interface{}) interface{} {
-	mapResult, ok := in.(map[interface{}]interface{})
-	if ok {
-		result := make(map[interface{}]interface{})
-		for k, v := range mapResult {
-			key := strings.ToLower(fmt.Sprint(k))
-			if strings.HasPrefix(key, "xxx_") {
-				delete(mapResult, key)
-				continue
-			}
-			v = doClean(v)
-			if v == nil {
-				continue
-			}
-			result[k] = v
+const (
+	OUTPUT_JSON       = "json"
+	OUTPUT_YAML       = "yaml"
+	OUTPUT_PROTO_TEXT = "proto-text"
+	//json of the resources as sent by the server, Struct configs are not expanded
+	OUTPUT_RAW = "raw"
+)
+
+var OutputFormats = []string{OUTPUT_JSON, OUTPUT_YAML, OUTPUT_PROTO_TEXT, OUTPUT_RAW}
 
+func ValidOutput(output string) bool {
+	for _, format := range OutputFormats {
+		if format == output {
+			return true
 		}
-		if len(result) == 1 {
-			for _, skipKey := range []string{"kind", "fields", "structvalue", "string_value", "attributes", "stringvalue", "boolvalue", "listvalue"} {
-				if result[skipKey] != nil {
-					return result[skipKey]
-				}
-			}
+	}
+	return false
+}
+
+// newConfigMessage returns the config type of the named extension, nil if unknown.
+func newConfigMessage(name string) proto.Message {
+	switch name {
+	case envoy.HTTPConnectionManager:
+		return &hcm.HttpConnectionManager{}
+	case envoy.TCPProxy:
+		return &tcp.TcpProxy{}
+	case envoy.RouterHttpFilter:
+		return &router.Router{}
+	case envoy.FileAccessLog:
+		return &als.FileAccessLog{}
+	case envoy.HttpGrpcAccessLog:
+		return &als.HttpGrpcAccessLogConfig{}
+	}
+	return nil
+}
+
+// expandConfig converts the Struct config of the named extension into a typed_config of its concrete type.
+// It returns nil if the type of the extension is unknown.
+func expandConfig(name string, config *types.Struct) (*types.Any, error) {
+	message := newConfigMessage(name)
+	if message == nil || config == nil {
+		return nil, nil
+	}
+	if err := envoy.StructToMessage(config, message); err != nil {
+		return nil, fmt.Errorf("failed to decode config of %s: %s", name, err.Error())
+	}
+	if manager, ok := message.(*hcm.HttpConnectionManager); ok {
+		if err := expandHttpConnectionManager(manager); err != nil {
+			return nil, err
+		}
+	}
+	return types.MarshalAny(message)
+}
+
+func expandAccessLogs(logs []*accesslog.AccessLog) error {
+	for _, log := range logs {
+		config, ok := log.ConfigType.(*accesslog.AccessLog_Config)
+		if !ok {
+			continue
+		}
+		typed, err := expandConfig(log.Name, config.Config)
+		if err != nil {
+			return err
+		}
+		if typed != nil {
+			log.ConfigType = &accesslog.AccessLog_TypedConfig{TypedConfig: typed}
+		}
+	}
+	return nil
+}
+
+func expandHttpConnectionManager(manager *hcm.HttpConnectionManager) error {
+	for _, filter := range manager.HttpFilters {
+		config, ok := filter.ConfigType.(*hcm.HttpFilter_Config)
+		if !ok {
+			continue
+		}
+		typed, err := expandConfig(filter.Name, config.Config)
+		if err != nil {
+			return err
 		}
-		return result
+		if typed != nil {
+			filter.ConfigType = &hcm.HttpFilter_TypedConfig{TypedConfig: typed}
+		}
+	}
+	return expandAccessLogs(manager.AccessLog)
+}
+
+// Expand returns a copy of message whose Struct filter and access log configs are replaced by
+// typed_config of their concrete types, as shown by envoy's /config_dump.
+func Expand(message proto.Message) (proto.Message, error) {
+	result := proto.Clone(message)
+	resource, ok := result.(*v2.Listener)
+	if !ok {
+		return result, nil
 	}
-	listResult, ok := in.([]interface{})
-	if ok {
-		var result []interface{}
-		for _, elem := range listResult {
-			result = append(result, doClean(elem))
+	for i := range resource.FilterChains {
+		chain := &resource.FilterChains[i]
+		for j := range chain.Filters {
+			filter := &chain.Filters[j]
+			config, ok := filter.ConfigType.(*listener.Filter_Config)
+			if !ok {
+				continue
+			}
+			typed, err := expandConfig(filter.Name, config.Config)
+			if err != nil {
+				return nil, fmt.Errorf("listener %s: %s", resource.Name, err.Error())
+			}
+			if typed != nil {
+				filter.ConfigType = &listener.Filter_TypedConfig{TypedConfig: typed}
+			}
 		}
-		return result
 	}
-	return in
+	return result, nil
 }
 
-func DoPrint(in interface{}) {
-	yaml_data, _ := yaml.Marshal(in)
-	data := make(map[interface{}]interface{})
-	yaml.Unmarshal(yaml_data, data)
+func marshalJson(message proto.Message) (string, error) {
+	return (&jsonpb.Marshaler{OrigName: true, Indent: "  "}).MarshalToString(message)
+}
 
-	yaml_data, _ = yaml.Marshal(doClean(data))
-	fmt.Printf("%s\n", yaml_data)
+// Format returns the text of message in the given output format.
+func Format(message proto.Message, output string) (string, error) {
+	if output == OUTPUT_RAW {
+		return marshalJson(message)
+	}
+	expanded, err := Expand(message)
+	if err != nil {
+		return "", err
+	}
+	switch output {
+	case OUTPUT_JSON:
+		return marshalJson(expanded)
+	case OUTPUT_YAML:
+		text, err := marshalJson(expanded)
+		if err != nil {
+			return "", err
+		}
+		data, err := yaml.JSONToYAML([]byte(text))
+		if err != nil {
+			return "", err
+		}
+		return string(data), nil
+	case OUTPUT_PROTO_TEXT:
+		return proto.MarshalTextString(expanded), nil
+	}
+	return "", fmt.Errorf("unknown output %s, expect one of %v", output, OutputFormats)
+}
 
+// Print writes messages in the given output format, json and raw output is a single array
+// and yaml output is a stream of documents so that the result can be parsed as a whole.
+func Print(w io.Writer, messages []proto.Message, output string) error {
+	var texts []string
+	for _, message := range messages {
+		text, err := Format(message, output)
+		if err != nil {
+			return err
+		}
+		texts = append(texts, strings.TrimRight(text, "\n"))
+	}
+	switch output {
+	case OUTPUT_JSON, OUTPUT_RAW:
+		fmt.Fprintf(w, "[\n%s\n]\n", strings.Join(texts, ",\n"))
+	case OUTPUT_YAML:
+		for _, text := range texts {
+			fmt.Fprintf(w, "---\n%s\n", text)
+		}
+	default:
+		for i, text := range texts {
+			fmt.Fprintf(w, "# %s\n%s\n", ResourceName(messages[i]), text)
+		}
+	}
+	return nil
 }
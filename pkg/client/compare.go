@@ -0,0 +1,440 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/route"
+	"github.com/gogo/protobuf/proto"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	LISTENER_TYPE       = "Listener"
+	CLUSTER_TYPE        = "Cluster"
+	ROUTE_TYPE          = "RouteConfiguration"
+	VIRTUAL_HOST_TYPE   = "VirtualHost"
+	ASSIGNMENT_TYPE     = "ClusterLoadAssignment"
+	DEFAULT_LB_WEIGHT   = 1
+	DEFAULT_ROUTE_TOTAL = 100
+)
+
+var differenceTypeOrder = []string{LISTENER_TYPE, CLUSTER_TYPE, ROUTE_TYPE, VIRTUAL_HOST_TYPE, ASSIGNMENT_TYPE}
+
+// listeners are matched by address, so their names are never mapped
+var nameRuleTypes = []string{CLUSTER_TYPE, ROUTE_TYPE, VIRTUAL_HOST_TYPE, ASSIGNMENT_TYPE}
+
+// NameRule rewrites the names of the given types which match the regular expression Match,
+// Replace may refer to submatches as $1. Cluster rules also apply to cluster names referenced
+// by routes and endpoint assignments, before the assignment rules.
+type NameRule struct {
+	Types   []string `yaml:"types"`
+	Match   string   `yaml:"match"`
+	Replace string   `yaml:"replace"`
+	regexp  *regexp.Regexp
+}
+
+// NameMapper normalises the resource names of different control planes so that they can be compared.
+type NameMapper struct {
+	rules []*NameRule
+}
+
+func NewNameMapper(rules []*NameRule) (*NameMapper, error) {
+	for _, rule := range rules {
+		for _, typeName := range rule.Types {
+			if !containsString(nameRuleTypes, typeName) {
+				return nil, fmt.Errorf("invalid name rule %s: unknown type %s, expect one of %s",
+					rule.Match, typeName, strings.Join(nameRuleTypes, ", "))
+			}
+		}
+		compiled, err := regexp.Compile(rule.Match)
+		if err != nil {
+			return nil, fmt.Errorf("invalid name rule %s: %s", rule.Match, err.Error())
+		}
+		rule.regexp = compiled
+	}
+	return &NameMapper{rules: rules}, nil
+}
+
+// LoadNameMapper reads a yaml list of NameRule, no name is rewritten if path is empty.
+func LoadNameMapper(path string) (*NameMapper, error) {
+	var rules []*NameRule
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := yaml.UnmarshalStrict(data, &rules); err != nil {
+			return nil, fmt.Errorf("failed to parse %s: %s", path, err.Error())
+		}
+	}
+	return NewNameMapper(rules)
+}
+
+// Map applies the rules of typeName in order to name.
+func (mapper *NameMapper) Map(typeName string, name string) string {
+	for _, rule := range mapper.rules {
+		if len(rule.Types) > 0 && !containsString(rule.Types, typeName) {
+			continue
+		}
+		name = rule.regexp.ReplaceAllString(name, rule.Replace)
+	}
+	return name
+}
+
+func containsString(list []string, value string) bool {
+	for _, elem := range list {
+		if elem == value {
+			return true
+		}
+	}
+	return false
+}
+
+type Difference struct {
+	Type string
+	//normalised name of the resource
+	Name   string
+	Detail string
+}
+
+// ConfigDiff reports the semantic differences between the configs two control planes
+// serve to the same node.
+type ConfigDiff struct {
+	LeftName  string
+	RightName string
+	Mapper    *NameMapper
+	result    []Difference
+}
+
+func (diff *ConfigDiff) add(typeName string, name string, format string, args ...interface{}) {
+	diff.result = append(diff.result, Difference{Type: typeName, Name: name, Detail: fmt.Sprintf(format, args...)})
+}
+
+func (diff *ConfigDiff) onlyIn(typeName string, left map[string]bool, right map[string]bool) {
+	for name := range left {
+		if !right[name] {
+			diff.add(typeName, name, "only in %s", diff.LeftName)
+		}
+	}
+	for name := range right {
+		if !left[name] {
+			diff.add(typeName, name, "only in %s", diff.RightName)
+		}
+	}
+}
+
+func (diff *ConfigDiff) Compare(left *NodeConfig, right *NodeConfig) []Difference {
+	diff.result = nil
+	diff.compareListeners(left.Listeners, right.Listeners)
+	diff.compareClusters(left.Clusters, right.Clusters)
+	diff.compareRoutes(left.Routes, right.Routes)
+	diff.compareEndpoints(left.Endpoints, right.Endpoints)
+
+	typeIndex := func(typeName string) int {
+		for i, elem := range differenceTypeOrder {
+			if elem == typeName {
+				return i
+			}
+		}
+		return len(differenceTypeOrder)
+	}
+	sort.SliceStable(diff.result, func(i, j int) bool {
+		a, b := diff.result[i], diff.result[j]
+		if a.Type != b.Type {
+			return typeIndex(a.Type) < typeIndex(b.Type)
+		}
+		if a.Name != b.Name {
+			return a.Name < b.Name
+		}
+		return a.Detail < b.Detail
+	})
+	return diff.result
+}
+
+func addressString(address *core.Address) string {
+	if socket := address.GetSocketAddress(); socket != nil {
+		return fmt.Sprintf("%s:%d", socket.Address, socket.GetPortValue())
+	}
+	return proto.CompactTextString(address)
+}
+
+// compareListeners matches listeners by address since listener names are not shared
+// between control planes.
+func (diff *ConfigDiff) compareListeners(left []*v2.Listener, right []*v2.Listener) {
+	addresses := func(listeners []*v2.Listener) map[string]bool {
+		result := make(map[string]bool)
+		for _, listener := range listeners {
+			result[addressString(&listener.Address)] = true
+		}
+		return result
+	}
+	diff.onlyIn(LISTENER_TYPE, addresses(left), addresses(right))
+}
+
+func (diff *ConfigDiff) compareClusters(left []*v2.Cluster, right []*v2.Cluster) {
+	clusterMap := func(clusters []*v2.Cluster) map[string]*v2.Cluster {
+		result := make(map[string]*v2.Cluster)
+		for _, cluster := range clusters {
+			result[diff.Mapper.Map(CLUSTER_TYPE, cluster.Name)] = cluster
+		}
+		return result
+	}
+	leftMap := clusterMap(left)
+	rightMap := clusterMap(right)
+	diff.onlyIn(CLUSTER_TYPE, keySet(leftMap), keySet(rightMap))
+	for name, leftCluster := range leftMap {
+		rightCluster := rightMap[name]
+		if rightCluster == nil {
+			continue
+		}
+		if leftCluster.GetType() != rightCluster.GetType() {
+			diff.add(CLUSTER_TYPE, name, "discovery type %s in %s, %s in %s",
+				leftCluster.GetType(), diff.LeftName, rightCluster.GetType(), diff.RightName)
+		}
+	}
+}
+
+// keySet returns the keys of a map with string keys.
+func keySet(in interface{}) map[string]bool {
+	result := make(map[string]bool)
+	for _, key := range reflect.ValueOf(in).MapKeys() {
+		result[key.String()] = true
+	}
+	return result
+}
+
+func (diff *ConfigDiff) compareRoutes(left []*v2.RouteConfiguration, right []*v2.RouteConfiguration) {
+	routeMap := func(routes []*v2.RouteConfiguration) map[string]*v2.RouteConfiguration {
+		result := make(map[string]*v2.RouteConfiguration)
+		for _, config := range routes {
+			result[diff.Mapper.Map(ROUTE_TYPE, config.Name)] = config
+		}
+		return result
+	}
+	leftMap := routeMap(left)
+	rightMap := routeMap(right)
+	diff.onlyIn(ROUTE_TYPE, keySet(leftMap), keySet(rightMap))
+	for name, leftConfig := range leftMap {
+		if rightConfig := rightMap[name]; rightConfig != nil {
+			diff.compareVirtualHosts(name, leftConfig.VirtualHosts, rightConfig.VirtualHosts)
+		}
+	}
+}
+
+// compareVirtualHosts pairs virtual hosts sharing a domain since their names are not shared
+// between control planes, and compares the routes of each pair.
+func (diff *ConfigDiff) compareVirtualHosts(routeName string, left []route.VirtualHost, right []route.VirtualHost) {
+	domainMap := func(hosts []route.VirtualHost) map[string]int {
+		result := make(map[string]int)
+		for i, host := range hosts {
+			for _, domain := range host.Domains {
+				result[domain] = i
+			}
+		}
+		return result
+	}
+	leftDomains := domainMap(left)
+	rightDomains := domainMap(right)
+
+	compared := make(map[[2]int]bool)
+	for i, host := range left {
+		var missing []string
+		for _, domain := range host.Domains {
+			j, ok := rightDomains[domain]
+			if !ok {
+				missing = append(missing, domain)
+				continue
+			}
+			if !compared[[2]int{i, j}] {
+				compared[[2]int{i, j}] = true
+				diff.compareVirtualHostRoutes(routeName, &host, &right[j])
+			}
+		}
+		if len(missing) > 0 {
+			diff.add(VIRTUAL_HOST_TYPE, routeName+"/"+diff.Mapper.Map(VIRTUAL_HOST_TYPE, host.Name), "domains %v only in %s", missing, diff.LeftName)
+		}
+	}
+	for _, host := range right {
+		var missing []string
+		for _, domain := range host.Domains {
+			if _, ok := leftDomains[domain]; !ok {
+				missing = append(missing, domain)
+			}
+		}
+		if len(missing) > 0 {
+			diff.add(VIRTUAL_HOST_TYPE, routeName+"/"+diff.Mapper.Map(VIRTUAL_HOST_TYPE, host.Name), "domains %v only in %s", missing, diff.RightName)
+		}
+	}
+}
+
+func (diff *ConfigDiff) routeActionString(r *route.Route) string {
+	action := r.GetRoute()
+	if action == nil {
+		if redirect := r.GetRedirect(); redirect != nil {
+			return "redirect " + proto.CompactTextString(redirect)
+		}
+		if response := r.GetDirectResponse(); response != nil {
+			return "direct response " + proto.CompactTextString(response)
+		}
+		return "no action"
+	}
+	if cluster := action.GetCluster(); cluster != "" {
+		return "cluster " + diff.Mapper.Map(CLUSTER_TYPE, cluster)
+	}
+	if weighted := action.GetWeightedClusters(); weighted != nil {
+		total := uint32(DEFAULT_ROUTE_TOTAL)
+		if weighted.TotalWeight != nil && weighted.TotalWeight.Value > 0 {
+			total = weighted.TotalWeight.Value
+		}
+		var clusters []string
+		for _, cluster := range weighted.Clusters {
+			var weight uint32
+			if cluster.Weight != nil {
+				weight = cluster.Weight.Value
+			}
+			//weights are compared as percentages since the total weight may differ
+			clusters = append(clusters, fmt.Sprintf("%s=%.1f%%",
+				diff.Mapper.Map(CLUSTER_TYPE, cluster.Name), float64(weight)*100/float64(total)))
+		}
+		sort.Strings(clusters)
+		return "weighted clusters " + strings.Join(clusters, ",")
+	}
+	if header := action.GetClusterHeader(); header != "" {
+		return "cluster from header " + header
+	}
+	return proto.CompactTextString(action)
+}
+
+func (diff *ConfigDiff) compareVirtualHostRoutes(routeName string, left *route.VirtualHost, right *route.VirtualHost) {
+	leftName := diff.Mapper.Map(VIRTUAL_HOST_TYPE, left.Name)
+	rightName := diff.Mapper.Map(VIRTUAL_HOST_TYPE, right.Name)
+	name := fmt.Sprintf("%s/%s", routeName, leftName)
+	if leftName != rightName {
+		name = fmt.Sprintf("%s/%s,%s", routeName, leftName, rightName)
+	}
+	routeActions := func(routes []route.Route) ([]string, map[string]string) {
+		var matches []string
+		actions := make(map[string]string)
+		for i := range routes {
+			match := proto.CompactTextString(&routes[i].Match)
+			if _, ok := actions[match]; ok {
+				//shadowed by a former route with the same match
+				continue
+			}
+			matches = append(matches, match)
+			actions[match] = diff.routeActionString(&routes[i])
+		}
+		return matches, actions
+	}
+	leftMatches, leftActions := routeActions(left.Routes)
+	rightMatches, rightActions := routeActions(right.Routes)
+
+	for _, match := range leftMatches {
+		rightAction, ok := rightActions[match]
+		if !ok {
+			diff.add(VIRTUAL_HOST_TYPE, name, "route {%s} only in %s", match, diff.LeftName)
+		} else if rightAction != leftActions[match] {
+			diff.add(VIRTUAL_HOST_TYPE, name, "route {%s} goes to %s in %s, %s in %s",
+				match, leftActions[match], diff.LeftName, rightAction, diff.RightName)
+		}
+	}
+	for _, match := range rightMatches {
+		if _, ok := leftActions[match]; !ok {
+			diff.add(VIRTUAL_HOST_TYPE, name, "route {%s} only in %s", match, diff.RightName)
+		}
+	}
+	if len(leftMatches) == len(rightMatches) {
+		for i := range leftMatches {
+			if _, ok := rightActions[leftMatches[i]]; ok && leftMatches[i] != rightMatches[i] {
+				diff.add(VIRTUAL_HOST_TYPE, name, "routes are evaluated in a different order")
+				break
+			}
+		}
+	}
+}
+
+// endpointWeights returns the effective weight of each endpoint address, including the priority if not 0.
+func endpointWeights(assignment *v2.ClusterLoadAssignment) map[string]string {
+	result := make(map[string]string)
+	for _, locality := range assignment.Endpoints {
+		for _, lbEndpoint := range locality.LbEndpoints {
+			endpoint := lbEndpoint.GetEndpoint()
+			if endpoint == nil || endpoint.Address == nil {
+				continue
+			}
+			weight := uint32(DEFAULT_LB_WEIGHT)
+			if lbEndpoint.LoadBalancingWeight != nil {
+				weight = lbEndpoint.LoadBalancingWeight.Value
+			}
+			value := fmt.Sprintf("weight %d", weight)
+			if locality.Priority > 0 {
+				value = fmt.Sprintf("%s priority %d", value, locality.Priority)
+			}
+			result[addressString(endpoint.Address)] = value
+		}
+	}
+	return result
+}
+
+func (diff *ConfigDiff) compareEndpoints(left []*v2.ClusterLoadAssignment, right []*v2.ClusterLoadAssignment) {
+	assignmentMap := func(assignments []*v2.ClusterLoadAssignment) map[string]map[string]string {
+		result := make(map[string]map[string]string)
+		for _, assignment := range assignments {
+			name := diff.Mapper.Map(ASSIGNMENT_TYPE, diff.Mapper.Map(CLUSTER_TYPE, assignment.ClusterName))
+			result[name] = endpointWeights(assignment)
+		}
+		return result
+	}
+	leftMap := assignmentMap(left)
+	rightMap := assignmentMap(right)
+	diff.onlyIn(ASSIGNMENT_TYPE, keySet(leftMap), keySet(rightMap))
+	for name, leftEndpoints := range leftMap {
+		rightEndpoints, ok := rightMap[name]
+		if !ok {
+			continue
+		}
+		var leftOnly, rightOnly []string
+		for address, leftWeight := range leftEndpoints {
+			rightWeight, ok := rightEndpoints[address]
+			if !ok {
+				leftOnly = append(leftOnly, address)
+			} else if rightWeight != leftWeight {
+				diff.add(ASSIGNMENT_TYPE, name, "endpoint %s has %s in %s, %s in %s",
+					address, leftWeight, diff.LeftName, rightWeight, diff.RightName)
+			}
+		}
+		for address := range rightEndpoints {
+			if _, ok := leftEndpoints[address]; !ok {
+				rightOnly = append(rightOnly, address)
+			}
+		}
+		if len(leftOnly) > 0 {
+			sort.Strings(leftOnly)
+			diff.add(ASSIGNMENT_TYPE, name, "endpoints %v only in %s", leftOnly, diff.LeftName)
+		}
+		if len(rightOnly) > 0 {
+			sort.Strings(rightOnly)
+			diff.add(ASSIGNMENT_TYPE, name, "endpoints %v only in %s", rightOnly, diff.RightName)
+		}
+	}
+}
+
+func PrintDifferences(w io.Writer, differences []Difference) {
+	var lastType string
+	for _, difference := range differences {
+		if difference.Type != lastType {
+			fmt.Fprintf(w, "%s:\n", difference.Type)
+			lastType = difference.Type
+		}
+		fmt.Fprintf(w, "  %s: %s\n", difference.Name, difference.Detail)
+	}
+	fmt.Fprintf(w, "%d differences\n", len(differences))
+}
@@ -0,0 +1,111 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2"
+)
+
+func TestNameMapperMap(t *testing.T) {
+	cases := []struct {
+		name     string
+		rules    []*NameRule
+		typeName string
+		input    string
+		expected string
+	}{
+		{
+			name:     "no rules",
+			typeName: CLUSTER_TYPE,
+			input:    "outbound|reviews:9080",
+			expected: "outbound|reviews:9080",
+		},
+		{
+			name: "submatch replacement",
+			rules: []*NameRule{
+				{Match: `^outbound\|(\w+):(\d+)$`, Replace: "outbound|$2||$1.default.svc.cluster.local"},
+			},
+			typeName: CLUSTER_TYPE,
+			input:    "outbound|reviews:9080",
+			expected: "outbound|9080||reviews.default.svc.cluster.local",
+		},
+		{
+			name: "later rules see the result of earlier ones",
+			rules: []*NameRule{
+				{Match: `^a$`, Replace: "b"},
+				{Match: `^b$`, Replace: "c"},
+			},
+			typeName: LISTENER_TYPE,
+			input:    "a",
+			expected: "c",
+		},
+		{
+			name: "earlier rules do not see the result of later ones",
+			rules: []*NameRule{
+				{Match: `^b$`, Replace: "c"},
+				{Match: `^a$`, Replace: "b"},
+			},
+			typeName: LISTENER_TYPE,
+			input:    "a",
+			expected: "b",
+		},
+		{
+			name: "rules of other types are skipped",
+			rules: []*NameRule{
+				{Types: []string{VIRTUAL_HOST_TYPE}, Match: `^a$`, Replace: "b"},
+				{Types: []string{CLUSTER_TYPE, ROUTE_TYPE}, Match: `^a$`, Replace: "c"},
+			},
+			typeName: ROUTE_TYPE,
+			input:    "a",
+			expected: "c",
+		},
+		{
+			name: "rules without types apply to all",
+			rules: []*NameRule{
+				{Types: []string{CLUSTER_TYPE}, Match: `:9080$`, Replace: ":http"},
+				{Match: `^outbound\|`, Replace: ""},
+			},
+			typeName: ASSIGNMENT_TYPE,
+			input:    "outbound|reviews:9080",
+			expected: "reviews:9080",
+		},
+	}
+	for _, c := range cases {
+		mapper, err := NewNameMapper(c.rules)
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err.Error())
+			continue
+		}
+		if result := mapper.Map(c.typeName, c.input); result != c.expected {
+			t.Errorf("%s: expect %s, got %s", c.name, c.expected, result)
+		}
+	}
+}
+
+func TestNameMapperInvalidRule(t *testing.T) {
+	if _, err := NewNameMapper([]*NameRule{{Match: "("}}); err == nil {
+		t.Errorf("expect error for invalid regular expression")
+	}
+	for _, typeName := range []string{"Clusters", LISTENER_TYPE} {
+		if _, err := NewNameMapper([]*NameRule{{Types: []string{typeName}, Match: "a"}}); err == nil {
+			t.Errorf("expect error for type %s", typeName)
+		}
+	}
+}
+
+func TestCompareEndpointsMapsAssignmentNames(t *testing.T) {
+	mapper, err := NewNameMapper([]*NameRule{
+		{Types: []string{ASSIGNMENT_TYPE}, Match: `^outbound\|`, Replace: ""},
+		{Types: []string{CLUSTER_TYPE}, Match: `^outbound\|(\d+)\|\|([^.]+)\..*$`, Replace: "outbound|$2:$1"},
+	})
+	if err != nil {
+		t.Fatal(err.Error())
+	}
+	diff := &ConfigDiff{LeftName: "left", RightName: "right", Mapper: mapper}
+	diff.compareEndpoints(
+		[]*v2.ClusterLoadAssignment{{ClusterName: "outbound|reviews:9080"}},
+		[]*v2.ClusterLoadAssignment{{ClusterName: "outbound|9080||reviews.default.svc.cluster.local"}})
+	if diff.result != nil {
+		t.Errorf("expect no difference, got %v", diff.result)
+	}
+}
@@ -0,0 +1,295 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/listener"
+	hcm "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/http_connection_manager/v2"
+	"github.com/ghodss/yaml"
+	"github.com/gogo/protobuf/proto"
+	"github.com/gogo/protobuf/types"
+	"github.com/luguoxiang/envoy-demo/pkg/envoy"
+)
+
+const adminTypePrefix = "type.googleapis.com/envoy.admin.v2alpha."
+
+// NodeConfig holds the resources of all types a control plane serves to one node.
+type NodeConfig struct {
+	Listeners []*v2.Listener
+	Clusters  []*v2.Cluster
+	Routes    []*v2.RouteConfiguration
+	Endpoints []*v2.ClusterLoadAssignment
+	//typeUrl -> version of the last response
+	Versions map[string]string
+}
+
+// decodeHttpConnectionManager returns the http connection manager config of filter, nil if filter is not one.
+func decodeHttpConnectionManager(filter *listener.Filter) (*hcm.HttpConnectionManager, error) {
+	if filter.Name != envoy.HTTPConnectionManager {
+		return nil, nil
+	}
+	manager := &hcm.HttpConnectionManager{}
+	switch config := filter.ConfigType.(type) {
+	case *listener.Filter_Config:
+		if err := envoy.StructToMessage(config.Config, manager); err != nil {
+			return nil, err
+		}
+	case *listener.Filter_TypedConfig:
+		if err := types.UnmarshalAny(config.TypedConfig, manager); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, nil
+	}
+	return manager, nil
+}
+
+// HttpConnectionManagers returns the decoded http connection manager configs of the filter chains of l.
+func HttpConnectionManagers(l *v2.Listener) ([]*hcm.HttpConnectionManager, error) {
+	var result []*hcm.HttpConnectionManager
+	for _, chain := range l.FilterChains {
+		for i := range chain.Filters {
+			manager, err := decodeHttpConnectionManager(&chain.Filters[i])
+			if err != nil {
+				return nil, fmt.Errorf("listener %s: %s", l.Name, err.Error())
+			}
+			if manager != nil {
+				result = append(result, manager)
+			}
+		}
+	}
+	return result, nil
+}
+
+func sortedNames(names map[string]bool) []string {
+	var result []string
+	for name := range names {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// FetchNodeConfig fetches the resources of a node the way envoy does: all listeners, the route
+// configurations they refer to, all clusters and the endpoints of EDS clusters.
+func FetchNodeConfig(client *XdsClient) (*NodeConfig, error) {
+	config := &NodeConfig{Versions: make(map[string]string)}
+	fetch := func(typeUrl string, names []string) ([]proto.Message, error) {
+		resp, err := client.Fetch(typeUrl, names)
+		if err != nil {
+			return nil, err
+		}
+		config.Versions[typeUrl] = resp.VersionInfo
+		return DecodeResources(resp)
+	}
+
+	resources, err := fetch(envoy.ListenerResource, nil)
+	if err != nil {
+		return nil, err
+	}
+	routeNames := make(map[string]bool)
+	for _, resource := range resources {
+		l := resource.(*v2.Listener)
+		config.Listeners = append(config.Listeners, l)
+		managers, err := HttpConnectionManagers(l)
+		if err != nil {
+			return nil, err
+		}
+		for _, manager := range managers {
+			if rds := manager.GetRds(); rds != nil {
+				routeNames[rds.RouteConfigName] = true
+			}
+		}
+	}
+	//an empty name list would request all resources
+	if len(routeNames) > 0 {
+		resources, err = fetch(envoy.RouteResource, sortedNames(routeNames))
+		if err != nil {
+			return nil, err
+		}
+		for _, resource := range resources {
+			config.Routes = append(config.Routes, resource.(*v2.RouteConfiguration))
+		}
+	}
+
+	resources, err = fetch(envoy.ClusterResource, nil)
+	if err != nil {
+		return nil, err
+	}
+	endpointNames := make(map[string]bool)
+	for _, resource := range resources {
+		cluster := resource.(*v2.Cluster)
+		config.Clusters = append(config.Clusters, cluster)
+		if cluster.GetType() != v2.Cluster_EDS {
+			continue
+		}
+		endpointNames[envoy.EndpointResourceName(cluster)] = true
+	}
+	if len(endpointNames) > 0 {
+		resources, err = fetch(envoy.EndpointResource, sortedNames(endpointNames))
+		if err != nil {
+			return nil, err
+		}
+		for _, resource := range resources {
+			config.Endpoints = append(config.Endpoints, resource.(*v2.ClusterLoadAssignment))
+		}
+	}
+	return config, nil
+}
+
+func (config *NodeConfig) HasResource(typeURL string, name string) bool {
+	switch typeURL {
+	case envoy.ListenerResource:
+		for _, l := range config.Listeners {
+			if l.Name == name {
+				return true
+			}
+		}
+	case envoy.ClusterResource:
+		for _, cluster := range config.Clusters {
+			if cluster.Name == name {
+				return true
+			}
+		}
+	case envoy.RouteResource:
+		for _, route := range config.Routes {
+			if route.Name == name {
+				return true
+			}
+		}
+	case envoy.EndpointResource:
+		for _, assignment := range config.Endpoints {
+			if assignment.ClusterName == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Validate checks the resources of every type like the control plane does before pushing them,
+// and the references between them.
+func (config *NodeConfig) Validate() *envoy.ValidationResult {
+	result := &envoy.ValidationResult{}
+	add := func(typeURL string, resources []proto.Message) {
+		typeResult := envoy.ValidateResources(typeURL, resources, config)
+		for _, err := range typeResult.Errors {
+			result.Errors = append(result.Errors, ShortTypeName(typeURL)+" "+err)
+		}
+		for _, warning := range typeResult.Warnings {
+			result.Warnings = append(result.Warnings, ShortTypeName(typeURL)+" "+warning)
+		}
+	}
+	var resources []proto.Message
+	for _, l := range config.Listeners {
+		resources = append(resources, l)
+	}
+	add(envoy.ListenerResource, resources)
+	resources = nil
+	for _, cluster := range config.Clusters {
+		resources = append(resources, cluster)
+	}
+	add(envoy.ClusterResource, resources)
+	resources = nil
+	for _, route := range config.Routes {
+		resources = append(resources, route)
+	}
+	add(envoy.RouteResource, resources)
+	resources = nil
+	for _, assignment := range config.Endpoints {
+		resources = append(resources, assignment)
+	}
+	add(envoy.EndpointResource, resources)
+	return result
+}
+
+type dumpedResource struct {
+	VersionInfo    string          `json:"version_info,omitempty"`
+	Listener       json.RawMessage `json:"listener,omitempty"`
+	Cluster        json.RawMessage `json:"cluster,omitempty"`
+	RouteConfig    json.RawMessage `json:"route_config,omitempty"`
+	EndpointConfig json.RawMessage `json:"endpoint_config,omitempty"`
+}
+
+type configDump struct {
+	Type                   string            `json:"@type"`
+	VersionInfo            string            `json:"version_info,omitempty"`
+	DynamicActiveListeners []*dumpedResource `json:"dynamic_active_listeners,omitempty"`
+	DynamicActiveClusters  []*dumpedResource `json:"dynamic_active_clusters,omitempty"`
+	DynamicRouteConfigs    []*dumpedResource `json:"dynamic_route_configs,omitempty"`
+	DynamicEndpointConfigs []*dumpedResource `json:"dynamic_endpoint_configs,omitempty"`
+}
+
+// Dump writes config as one document laid out like envoy's /config_dump, output is json, yaml or raw.
+func (config *NodeConfig) Dump(w io.Writer, output string) error {
+	if output == OUTPUT_PROTO_TEXT {
+		return fmt.Errorf("output %s is not supported by dump", output)
+	}
+	//resources are embedded as json, yaml output is converted as a whole
+	embedded := output
+	if output == OUTPUT_YAML {
+		embedded = OUTPUT_JSON
+	}
+	var dumpErr error
+	marshal := func(message proto.Message) json.RawMessage {
+		text, err := Format(message, embedded)
+		if err != nil && dumpErr == nil {
+			dumpErr = err
+		}
+		return json.RawMessage(text)
+	}
+
+	listeners := &configDump{Type: adminTypePrefix + "ListenersConfigDump", VersionInfo: config.Versions[envoy.ListenerResource]}
+	for _, l := range config.Listeners {
+		listeners.DynamicActiveListeners = append(listeners.DynamicActiveListeners,
+			&dumpedResource{VersionInfo: listeners.VersionInfo, Listener: marshal(l)})
+	}
+	clusters := &configDump{Type: adminTypePrefix + "ClustersConfigDump", VersionInfo: config.Versions[envoy.ClusterResource]}
+	for _, cluster := range config.Clusters {
+		clusters.DynamicActiveClusters = append(clusters.DynamicActiveClusters,
+			&dumpedResource{VersionInfo: clusters.VersionInfo, Cluster: marshal(cluster)})
+	}
+	routes := &configDump{Type: adminTypePrefix + "RoutesConfigDump"}
+	for _, route := range config.Routes {
+		routes.DynamicRouteConfigs = append(routes.DynamicRouteConfigs,
+			&dumpedResource{VersionInfo: config.Versions[envoy.RouteResource], RouteConfig: marshal(route)})
+	}
+	endpoints := &configDump{Type: adminTypePrefix + "EndpointsConfigDump"}
+	for _, assignment := range config.Endpoints {
+		endpoints.DynamicEndpointConfigs = append(endpoints.DynamicEndpointConfigs,
+			&dumpedResource{VersionInfo: config.Versions[envoy.EndpointResource], EndpointConfig: marshal(assignment)})
+	}
+	if dumpErr != nil {
+		return dumpErr
+	}
+
+	data, err := json.Marshal(map[string]interface{}{
+		"configs": []*configDump{listeners, clusters, routes, endpoints},
+	})
+	if err != nil {
+		return err
+	}
+	return writeDocument(w, data, output)
+}
+
+// writeDocument writes json data indented, or converted to yaml.
+func writeDocument(w io.Writer, data []byte, output string) error {
+	var err error
+	if output == OUTPUT_YAML {
+		data, err = yaml.JSONToYAML(data)
+	} else {
+		var indented bytes.Buffer
+		err = json.Indent(&indented, data, "", "  ")
+		data = indented.Bytes()
+	}
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "%s\n", data)
+	return err
+}
@@ -0,0 +1,136 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+const (
+	RESOURCE_ADDED   = "+"
+	RESOURCE_REMOVED = "-"
+	RESOURCE_CHANGED = "~"
+)
+
+type ResourceChange struct {
+	Name string
+	Kind string
+	//line diff of changed resources, the whole text of added and removed ones
+	Lines []string
+}
+
+// DiffResources compares two sets of formatted resources keyed by name.
+func DiffResources(oldResources map[string]string, newResources map[string]string) []ResourceChange {
+	var result []ResourceChange
+	for name, text := range newResources {
+		oldText, ok := oldResources[name]
+		if !ok {
+			result = append(result, ResourceChange{Name: name, Kind: RESOURCE_ADDED, Lines: prefixLines("+ ", text)})
+		} else if oldText != text {
+			result = append(result, ResourceChange{Name: name, Kind: RESOURCE_CHANGED, Lines: DiffLines(oldText, text)})
+		}
+	}
+	for name, text := range oldResources {
+		if _, ok := newResources[name]; !ok {
+			result = append(result, ResourceChange{Name: name, Kind: RESOURCE_REMOVED, Lines: prefixLines("- ", text)})
+		}
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result
+}
+
+func splitLines(text string) []string {
+	return strings.Split(strings.TrimRight(text, "\n"), "\n")
+}
+
+func prefixLines(prefix string, text string) []string {
+	var result []string
+	for _, line := range splitLines(text) {
+		result = append(result, prefix+line)
+	}
+	return result
+}
+
+// DiffLines returns the changed lines between two texts, prefixed with "- " and "+ ",
+// with up to two unchanged lines of context around them.
+func DiffLines(oldText string, newText string) []string {
+	a := splitLines(oldText)
+	b := splitLines(newText)
+	//lcs[i][j] is the longest common subsequence of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	var all []string
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			all = append(all, "  "+a[i])
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			//deletions first like diff(1)
+			all = append(all, "- "+a[i])
+			i++
+		default:
+			all = append(all, "+ "+b[j])
+			j++
+		}
+	}
+
+	const context = 2
+	keep := make([]bool, len(all))
+	for index, line := range all {
+		if strings.HasPrefix(line, "  ") {
+			continue
+		}
+		for k := index - context; k <= index+context; k++ {
+			if k >= 0 && k < len(all) {
+				keep[k] = true
+			}
+		}
+	}
+	var result []string
+	skipped := false
+	for index, line := range all {
+		if !keep[index] {
+			skipped = true
+			continue
+		}
+		if skipped && len(result) > 0 {
+			result = append(result, "  ...")
+		}
+		skipped = false
+		result = append(result, line)
+	}
+	return result
+}
+
+func PrintChanges(w io.Writer, header string, changes []ResourceChange) {
+	if len(changes) == 0 {
+		fmt.Fprintf(w, "%s: no changes\n", header)
+		return
+	}
+	fmt.Fprintf(w, "%s: %d changed\n", header, len(changes))
+	for _, change := range changes {
+		fmt.Fprintf(w, "%s %s\n", change.Kind, change.Name)
+		for _, line := range change.Lines {
+			fmt.Fprintf(w, "    %s\n", line)
+		}
+	}
+}
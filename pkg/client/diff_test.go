@@ -0,0 +1,76 @@
+package client
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func numberedLines(count int, replace map[int]string) string {
+	var lines []string
+	for i := 1; i <= count; i++ {
+		line := fmt.Sprintf("l%d", i)
+		if replaced, ok := replace[i]; ok {
+			line = replaced
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n") + "\n"
+}
+
+func TestDiffLines(t *testing.T) {
+	cases := []struct {
+		name     string
+		oldText  string
+		newText  string
+		expected []string
+	}{
+		{
+			name:     "identical",
+			oldText:  "a\nb\n",
+			newText:  "a\nb",
+			expected: nil,
+		},
+		{
+			name:     "changed line",
+			oldText:  "a\nb\nc\n",
+			newText:  "a\nx\nc\n",
+			expected: []string{"  a", "- b", "+ x", "  c"},
+		},
+		{
+			name:     "added line",
+			oldText:  "a\nc\n",
+			newText:  "a\nb\nc\n",
+			expected: []string{"  a", "+ b", "  c"},
+		},
+		{
+			name:     "removed line",
+			oldText:  "a\nb\nc\n",
+			newText:  "a\nc\n",
+			expected: []string{"  a", "- b", "  c"},
+		},
+		{
+			name:     "context trimmed around a change",
+			oldText:  numberedLines(9, nil),
+			newText:  numberedLines(9, map[int]string{5: "L5"}),
+			expected: []string{"  l3", "  l4", "- l5", "+ L5", "  l6", "  l7"},
+		},
+		{
+			name:    "unchanged lines between changes are elided",
+			oldText: numberedLines(9, nil),
+			newText: numberedLines(9, map[int]string{1: "L1", 9: "L9"}),
+			expected: []string{
+				"- l1", "+ L1", "  l2", "  l3",
+				"  ...",
+				"  l7", "  l8", "- l9", "+ L9",
+			},
+		},
+	}
+	for _, c := range cases {
+		result := DiffLines(c.oldText, c.newText)
+		if !reflect.DeepEqual(result, c.expected) {
+			t.Errorf("%s: expect %q, got %q", c.name, c.expected, result)
+		}
+	}
+}
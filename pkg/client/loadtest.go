@@ -0,0 +1,391 @@
+package client
+
+import (
+	"fmt"
+	"hash/fnv"
+	"io"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v2"
+	"github.com/gogo/protobuf/proto"
+	"github.com/luguoxiang/envoy-demo/pkg/envoy"
+	"github.com/luguoxiang/envoy-demo/pkg/kubernetes"
+	"google.golang.org/grpc"
+)
+
+// FakePodSource feeds pods to discovery services the way K8sResourceManager.WatchPods does.
+type FakePodSource struct {
+	mutex    sync.Mutex
+	handlers []kubernetes.PodEventHandler
+	pods     []*kubernetes.PodInfo
+	serial   int
+	revision int
+}
+
+func NewFakePodSource(handlers ...kubernetes.PodEventHandler) *FakePodSource {
+	return &FakePodSource{handlers: handlers}
+}
+
+func (source *FakePodSource) nextRevision() string {
+	source.revision++
+	return strconv.Itoa(source.revision)
+}
+
+func (source *FakePodSource) Add(app string, version string) *kubernetes.PodInfo {
+	source.mutex.Lock()
+	defer source.mutex.Unlock()
+
+	source.serial++
+	pod := &kubernetes.PodInfo{
+		ResourceVersion: source.nextRevision(),
+		Name:            fmt.Sprintf("%s-%s-%d", app, version, source.serial),
+		Namespace:       kubernetes.GetMeshConfig().AppNamespace,
+		PodIP:           fmt.Sprintf("10.%d.%d.%d", source.serial>>16&0xff, source.serial>>8&0xff, source.serial&0xff),
+		Annotations:     map[string]string{},
+		Labels:          map[string]string{kubernetes.APP_LABEL: app, kubernetes.VERSION_LABEL: version},
+		Ready:           true,
+	}
+	source.pods = append(source.pods, pod)
+	for _, h := range source.handlers {
+		if h.PodValid(pod) {
+			h.PodAdded(pod)
+		}
+	}
+	return pod
+}
+
+func (source *FakePodSource) Delete(pod *kubernetes.PodInfo) {
+	source.mutex.Lock()
+	defer source.mutex.Unlock()
+
+	for i, elem := range source.pods {
+		if elem == pod {
+			source.pods = append(source.pods[:i], source.pods[i+1:]...)
+			break
+		}
+	}
+	for _, h := range source.handlers {
+		if h.PodValid(pod) {
+			h.PodDeleted(pod)
+		}
+	}
+}
+
+// SetWeight changes the endpoint weight annotation of the pod at index.
+func (source *FakePodSource) SetWeight(index int, weight uint32) {
+	source.mutex.Lock()
+	defer source.mutex.Unlock()
+
+	oldPod := source.pods[index]
+	newPod := *oldPod
+	newPod.ResourceVersion = source.nextRevision()
+	newPod.Annotations = map[string]string{kubernetes.ENDPOINT_WEIGHT_ANNOTATION: strconv.Itoa(int(weight))}
+	source.pods[index] = &newPod
+	for _, h := range source.handlers {
+		if h.PodValid(&newPod) {
+			h.PodUpdated(oldPod, &newPod)
+		}
+	}
+}
+
+func (source *FakePodSource) Pods() []*kubernetes.PodInfo {
+	source.mutex.Lock()
+	defer source.mutex.Unlock()
+
+	return append([]*kubernetes.PodInfo(nil), source.pods...)
+}
+
+// versionStats is the delivery of one version of a resource type to the fake nodes.
+type versionStats struct {
+	typeUrl string
+	version string
+	//index of the mutation which produced the version, -1 for the initial config
+	mutation  int
+	first     time.Time
+	last      time.Time
+	nodes     map[string]bool
+	bytes     int64
+	responses int
+}
+
+type pushRecorder struct {
+	mutex     sync.Mutex
+	start     time.Time
+	mutations []time.Time
+	stats     map[string]*versionStats
+	order     []*versionStats
+	errors    map[string]error
+}
+
+func newPushRecorder() *pushRecorder {
+	return &pushRecorder{
+		start:  time.Now(),
+		stats:  make(map[string]*versionStats),
+		errors: make(map[string]error),
+	}
+}
+
+func (recorder *pushRecorder) mutated() {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	recorder.mutations = append(recorder.mutations, time.Now())
+}
+
+func (recorder *pushRecorder) received(node string, resp *v2.DiscoveryResponse) {
+	now := time.Now()
+	size := proto.Size(resp)
+
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	key := resp.TypeUrl + "@" + resp.VersionInfo
+	stats := recorder.stats[key]
+	if stats == nil {
+		stats = &versionStats{
+			typeUrl:  resp.TypeUrl,
+			version:  resp.VersionInfo,
+			mutation: len(recorder.mutations) - 1,
+			first:    now,
+			nodes:    make(map[string]bool),
+		}
+		recorder.stats[key] = stats
+		recorder.order = append(recorder.order, stats)
+	}
+	stats.last = now
+	stats.nodes[node] = true
+	stats.bytes += int64(size)
+	stats.responses++
+}
+
+func (recorder *pushRecorder) failed(node string, err error) {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+	recorder.errors[node] = err
+}
+
+func shortVersion(version string) string {
+	h := fnv.New32a()
+	h.Write([]byte(version))
+	return fmt.Sprintf("%08x", h.Sum32())
+}
+
+func (recorder *pushRecorder) report(w io.Writer, nodes int) {
+	recorder.mutex.Lock()
+	defer recorder.mutex.Unlock()
+
+	writer := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(writer, "TYPE\tVERSION\tMUTATION\tNODES\tFIRST\tCONVERGED\tRESPONSES\tBYTES")
+	var totalBytes int64
+	var totalResponses int
+	for _, stats := range recorder.order {
+		base := recorder.start
+		mutation := "initial"
+		if stats.mutation >= 0 {
+			base = recorder.mutations[stats.mutation]
+			mutation = strconv.Itoa(stats.mutation + 1)
+		}
+		converged := "-"
+		if len(stats.nodes) == nodes {
+			converged = stats.last.Sub(base).String()
+		}
+		fmt.Fprintf(writer, "%s\t%s\t%s\t%d/%d\t%s\t%s\t%d\t%d\n",
+			ShortTypeName(stats.typeUrl), shortVersion(stats.version), mutation, len(stats.nodes), nodes,
+			stats.first.Sub(base), converged, stats.responses, stats.bytes)
+		totalBytes += stats.bytes
+		totalResponses += stats.responses
+	}
+	writer.Flush()
+	fmt.Fprintf(w, "%d responses, %d bytes, %d failed nodes\n", totalResponses, totalBytes, len(recorder.errors))
+	var failed []string
+	for node, err := range recorder.errors {
+		failed = append(failed, fmt.Sprintf("  %s: %s", node, err.Error()))
+	}
+	sort.Strings(failed)
+	for _, line := range failed {
+		fmt.Fprintln(w, line)
+	}
+}
+
+// fakeNode subscribes like an envoy sidecar: listeners and clusters first, then the routes and
+// endpoints they refer to, acking every response.
+type fakeNode struct {
+	id       string
+	client   *XdsClient
+	names    map[string][]string
+	versions map[string]string
+	nonces   map[string]string
+}
+
+func sameNames(a []string, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// follow subscribes the resources of typeUrl referred to by other resources.
+func (node *fakeNode) follow(typeUrl string, names []string) error {
+	if len(names) == 0 || sameNames(node.names[typeUrl], names) {
+		return nil
+	}
+	node.names[typeUrl] = names
+	return node.client.Send(typeUrl, names, node.versions[typeUrl], node.nonces[typeUrl])
+}
+
+func (node *fakeNode) run(recorder *pushRecorder) error {
+	for _, typeUrl := range []string{envoy.ClusterResource, envoy.ListenerResource} {
+		if err := node.client.Send(typeUrl, nil, "", ""); err != nil {
+			return err
+		}
+	}
+	for {
+		resp, err := node.client.Recv()
+		if err != nil {
+			return err
+		}
+		recorder.received(node.id, resp)
+		changed := node.versions[resp.TypeUrl] != resp.VersionInfo
+		node.versions[resp.TypeUrl] = resp.VersionInfo
+		node.nonces[resp.TypeUrl] = resp.Nonce
+		if err := node.client.Send(resp.TypeUrl, node.names[resp.TypeUrl], resp.VersionInfo, resp.Nonce); err != nil {
+			return err
+		}
+		if !changed {
+			continue
+		}
+
+		resources, err := DecodeResources(resp)
+		if err != nil {
+			return err
+		}
+		names := make(map[string]bool)
+		switch resp.TypeUrl {
+		case envoy.ListenerResource:
+			for _, resource := range resources {
+				managers, err := HttpConnectionManagers(resource.(*v2.Listener))
+				if err != nil {
+					return err
+				}
+				for _, manager := range managers {
+					if rds := manager.GetRds(); rds != nil {
+						names[rds.RouteConfigName] = true
+					}
+				}
+			}
+			err = node.follow(envoy.RouteResource, sortedNames(names))
+		case envoy.ClusterResource:
+			for _, resource := range resources {
+				cluster := resource.(*v2.Cluster)
+				if cluster.GetType() == v2.Cluster_EDS {
+					names[envoy.EndpointResourceName(cluster)] = true
+				}
+			}
+			err = node.follow(envoy.EndpointResource, sortedNames(names))
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+type LoadTest struct {
+	Nodes     int
+	Mutations int
+	//time between mutations, also the time waited for the initial config
+	Interval time.Duration
+	//time waited for the last mutation to converge
+	Settle time.Duration
+	Out    io.Writer
+}
+
+// Run starts an in-process control plane fed by a FakePodSource with one pod per fake node, connects
+// the nodes, mutates the pods and reports how each version reached the nodes.
+func (test *LoadTest) Run() error {
+	cds := envoy.NewClustersDiscoveryService()
+	eds := envoy.NewEndpointsDiscoveryService()
+	lds := envoy.NewListenersDiscoveryService()
+	rds := envoy.NewRoutesDiscoveryService()
+	ads := envoy.NewAggregatedDiscoveryService(cds, eds, lds, rds)
+	source := NewFakePodSource(cds, eds, lds)
+
+	var apps []string
+	for app := range kubernetes.GetMeshConfig().Apps {
+		apps = append(apps, app)
+	}
+	sort.Strings(apps)
+	var pods []*kubernetes.PodInfo
+	for i := 0; i < test.Nodes; i++ {
+		pods = append(pods, source.Add(apps[i%len(apps)], "v1"))
+	}
+
+	grpcServer := grpc.NewServer(grpc.MaxConcurrentStreams(uint32(test.Nodes) * 4))
+	discovery.RegisterAggregatedDiscoveryServiceServer(grpcServer, ads)
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	go grpcServer.Serve(lis)
+	defer grpcServer.Stop()
+
+	recorder := newPushRecorder()
+	var clients []*XdsClient
+	defer func() {
+		for _, client := range clients {
+			client.Close()
+		}
+	}()
+	for _, pod := range pods {
+		client, err := NewXdsClient(lis.Addr().String(), pod.Name)
+		if err != nil {
+			return err
+		}
+		clients = append(clients, client)
+		node := &fakeNode{
+			id:       pod.Name,
+			client:   client,
+			names:    make(map[string][]string),
+			versions: make(map[string]string),
+			nonces:   make(map[string]string),
+		}
+		go func() {
+			if err := node.run(recorder); err != nil {
+				recorder.failed(node.id, err)
+			}
+		}()
+	}
+	fmt.Fprintf(test.Out, "%d nodes connected in %s\n", test.Nodes, time.Since(recorder.start))
+
+	time.Sleep(test.Interval)
+	for i := 0; i < test.Mutations; i++ {
+		current := source.Pods()
+		index := rand.Intn(len(current))
+		recorder.mutated()
+		if i%3 == 2 {
+			//replace a pod: endpoints, clusters and listeners change
+			pod := current[index]
+			source.Delete(pod)
+			source.Add(pod.App(), pod.Version())
+		} else {
+			//change a weight: only endpoints change
+			source.SetWeight(index, uint32(1+rand.Intn(kubernetes.MAX_WEIGHT)))
+		}
+		if i == test.Mutations-1 {
+			time.Sleep(test.Settle)
+		} else {
+			time.Sleep(test.Interval)
+		}
+	}
+	recorder.report(test.Out, test.Nodes)
+	return nil
+}
@@ -0,0 +1,546 @@
+package client
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/endpoint"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/listener"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/route"
+	tcp "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/tcp_proxy/v2"
+	"github.com/gogo/protobuf/proto"
+	"github.com/gogo/protobuf/types"
+	"github.com/luguoxiang/envoy-demo/pkg/envoy"
+)
+
+// SimulatedRequest is a request sent by the application of a node through its proxy.
+type SimulatedRequest struct {
+	//destination host name or ip
+	Host    string
+	Port    uint32
+	Path    string
+	Method  string
+	Headers map[string]string
+}
+
+func (request *SimulatedRequest) authority() string {
+	if host, ok := request.Headers[":authority"]; ok {
+		return host
+	}
+	if host, ok := request.Headers["host"]; ok {
+		return host
+	}
+	return fmt.Sprintf("%s:%d", request.Host, request.Port)
+}
+
+// header returns the value of a request header including the pseudo headers envoy matches on.
+func (request *SimulatedRequest) header(name string) (string, bool) {
+	switch strings.ToLower(name) {
+	case ":method":
+		return request.Method, true
+	case ":path":
+		return request.Path, true
+	case ":authority", "host":
+		return request.authority(), true
+	}
+	value, ok := request.Headers[strings.ToLower(name)]
+	return value, ok
+}
+
+// Simulation explains how the proxy of a node would route a request with the config it received.
+type Simulation struct {
+	Config *NodeConfig
+	Out    io.Writer
+}
+
+func (simulation *Simulation) explain(format string, args ...interface{}) {
+	fmt.Fprintf(simulation.Out, format+"\n", args...)
+}
+
+func (simulation *Simulation) Run(request *SimulatedRequest) error {
+	l := simulation.findListener(request)
+	if l == nil {
+		return fmt.Errorf("no listener handles %s:%d", request.Host, request.Port)
+	}
+	chain := simulation.findFilterChain(l, request)
+	if chain == nil {
+		return fmt.Errorf("no filter chain of listener %s matches %s:%d", l.Name, request.Host, request.Port)
+	}
+	for _, filter := range chain.Filters {
+		switch filter.Name {
+		case envoy.HTTPConnectionManager:
+			return simulation.routeHttp(l, request)
+		case envoy.TCPProxy:
+			return simulation.routeTcp(&filter)
+		}
+	}
+	return fmt.Errorf("filter chain of listener %s has neither %s nor %s", l.Name, envoy.HTTPConnectionManager, envoy.TCPProxy)
+}
+
+// findListener follows envoy's original destination handoff: the listener bound to the destination
+// ip and port, then the wildcard listener of the port, then the listener with use_original_dst itself.
+func (simulation *Simulation) findListener(request *SimulatedRequest) *v2.Listener {
+	exact := fmt.Sprintf("%s:%d", request.Host, request.Port)
+	wildcard := fmt.Sprintf("0.0.0.0:%d", request.Port)
+	for _, l := range simulation.Config.Listeners {
+		if addressString(&l.Address) == exact {
+			simulation.explain("listener %s: address %s is the destination", l.Name, exact)
+			return l
+		}
+	}
+	for _, l := range simulation.Config.Listeners {
+		if addressString(&l.Address) == wildcard {
+			simulation.explain("listener %s: address %s matches destination port %d, no listener on %s", l.Name, wildcard, request.Port, exact)
+			return l
+		}
+	}
+	for _, l := range simulation.Config.Listeners {
+		if l.UseOriginalDst != nil && l.UseOriginalDst.Value {
+			simulation.explain("listener %s: no listener on %s or %s, the connection stays on the original destination listener %s",
+				l.Name, exact, wildcard, addressString(&l.Address))
+			return l
+		}
+	}
+	return nil
+}
+
+func (simulation *Simulation) findFilterChain(l *v2.Listener, request *SimulatedRequest) *listener.FilterChain {
+	ip := net.ParseIP(request.Host)
+	for i := range l.FilterChains {
+		chain := &l.FilterChains[i]
+		match := chain.FilterChainMatch
+		if match == nil {
+			simulation.explain("filter chain %d: has no match conditions", i)
+			return chain
+		}
+		if match.DestinationPort != nil && match.DestinationPort.Value != request.Port {
+			simulation.explain("filter chain %d: destination port %d is not %d", i, request.Port, match.DestinationPort.Value)
+			continue
+		}
+		if len(match.ServerNames) > 0 {
+			if !containsString(match.ServerNames, request.Host) {
+				simulation.explain("filter chain %d: server name %s is not one of %v", i, request.Host, match.ServerNames)
+				continue
+			}
+			simulation.explain("filter chain %d: server name %s matches", i, request.Host)
+			return chain
+		}
+		if len(match.PrefixRanges) > 0 {
+			for _, cidr := range match.PrefixRanges {
+				var prefixLen uint32 = 32
+				if cidr.PrefixLen != nil {
+					prefixLen = cidr.PrefixLen.Value
+				}
+				_, network, err := net.ParseCIDR(fmt.Sprintf("%s/%d", cidr.AddressPrefix, prefixLen))
+				if err == nil && ip != nil && network.Contains(ip) {
+					simulation.explain("filter chain %d: destination %s is in %s", i, request.Host, network)
+					return chain
+				}
+			}
+			simulation.explain("filter chain %d: destination %s is not in its prefix ranges", i, request.Host)
+			continue
+		}
+		simulation.explain("filter chain %d: matches all destinations", i)
+		return chain
+	}
+	return nil
+}
+
+func (simulation *Simulation) routeTcp(filter *listener.Filter) error {
+	proxy := &tcp.TcpProxy{}
+	switch config := filter.ConfigType.(type) {
+	case *listener.Filter_Config:
+		if err := envoy.StructToMessage(config.Config, proxy); err != nil {
+			return err
+		}
+	case *listener.Filter_TypedConfig:
+		if err := types.UnmarshalAny(config.TypedConfig, proxy); err != nil {
+			return err
+		}
+	}
+	cluster := proxy.GetCluster()
+	if cluster == "" {
+		return fmt.Errorf("tcp proxy has no single cluster: %s", proto.CompactTextString(proxy))
+	}
+	simulation.explain("tcp proxy: forwards the connection to cluster %s", cluster)
+	return simulation.listEndpoints([]weightedCluster{{name: cluster, share: 1}})
+}
+
+func (simulation *Simulation) routeHttp(l *v2.Listener, request *SimulatedRequest) error {
+	managers, err := HttpConnectionManagers(l)
+	if err != nil {
+		return err
+	}
+	if len(managers) == 0 {
+		return fmt.Errorf("listener %s has no http connection manager", l.Name)
+	}
+	manager := managers[0]
+	config := manager.GetRouteConfig()
+	if rds := manager.GetRds(); rds != nil {
+		for _, routeConfig := range simulation.Config.Routes {
+			if routeConfig.Name == rds.RouteConfigName {
+				config = routeConfig
+			}
+		}
+		if config == nil {
+			return fmt.Errorf("route configuration %s was not received", rds.RouteConfigName)
+		}
+		simulation.explain("http connection manager: uses route configuration %s", config.Name)
+	} else if config != nil {
+		simulation.explain("http connection manager: uses inline route configuration %s", config.Name)
+	} else {
+		return fmt.Errorf("http connection manager of listener %s has no route configuration", l.Name)
+	}
+
+	host := simulation.findVirtualHost(config, request)
+	if host == nil {
+		return fmt.Errorf("no virtual host of %s matches authority %s, envoy returns 404", config.Name, request.authority())
+	}
+	r := simulation.findRoute(host, request)
+	if r == nil {
+		return fmt.Errorf("no route of virtual host %s matches, envoy returns 404", host.Name)
+	}
+	clusters, err := simulation.routeClusters(r, request)
+	if err != nil || len(clusters) == 0 {
+		return err
+	}
+	return simulation.listEndpoints(clusters)
+}
+
+// findVirtualHost applies envoy's domain precedence: exact domains, then the longest suffix
+// wildcard such as *.example.com, then *.
+func (simulation *Simulation) findVirtualHost(config *v2.RouteConfiguration, request *SimulatedRequest) *route.VirtualHost {
+	authority := strings.ToLower(request.authority())
+	var best *route.VirtualHost
+	var bestDomain string
+	var defaultHost *route.VirtualHost
+	for i := range config.VirtualHosts {
+		host := &config.VirtualHosts[i]
+		for _, domain := range host.Domains {
+			domain = strings.ToLower(domain)
+			switch {
+			case domain == authority:
+				simulation.explain("virtual host %s: domain %s matches authority %s exactly", host.Name, domain, authority)
+				return host
+			case domain == "*":
+				if defaultHost == nil {
+					defaultHost = host
+				}
+			case strings.HasPrefix(domain, "*") && strings.HasSuffix(authority, domain[1:]) && len(domain) > len(bestDomain):
+				best = host
+				bestDomain = domain
+			}
+		}
+	}
+	if best != nil {
+		simulation.explain("virtual host %s: wildcard domain %s is the longest suffix of authority %s", best.Name, bestDomain, authority)
+		return best
+	}
+	if defaultHost != nil {
+		simulation.explain("virtual host %s: no other domain matches authority %s, * matches all", defaultHost.Name, authority)
+	}
+	return defaultHost
+}
+
+func (simulation *Simulation) findRoute(host *route.VirtualHost, request *SimulatedRequest) *route.Route {
+	for i := range host.Routes {
+		r := &host.Routes[i]
+		match := proto.CompactTextString(&r.Match)
+		if reason := simulation.routeMismatch(&r.Match, request); reason != "" {
+			simulation.explain("route %d {%s}: %s", i, match, reason)
+			continue
+		}
+		simulation.explain("route %d {%s}: matches %s %s", i, match, request.Method, request.Path)
+		return r
+	}
+	return nil
+}
+
+func fullMatch(pattern string, value string) bool {
+	matched, err := regexp.MatchString("^(?:"+pattern+")$", value)
+	return err == nil && matched
+}
+
+// routeMismatch returns why match does not match request, empty if it matches.
+func (simulation *Simulation) routeMismatch(match *route.RouteMatch, request *SimulatedRequest) string {
+	path := request.Path
+	query := ""
+	if index := strings.Index(path, "?"); index >= 0 {
+		path, query = path[:index], path[index+1:]
+	}
+	caseSensitive := match.CaseSensitive == nil || match.CaseSensitive.Value
+	comparedPath := path
+	if !caseSensitive {
+		comparedPath = strings.ToLower(path)
+	}
+	switch specifier := match.PathSpecifier.(type) {
+	case *route.RouteMatch_Prefix:
+		prefix := specifier.Prefix
+		if !caseSensitive {
+			prefix = strings.ToLower(prefix)
+		}
+		if !strings.HasPrefix(comparedPath, prefix) {
+			return fmt.Sprintf("path %s does not start with %s", path, specifier.Prefix)
+		}
+	case *route.RouteMatch_Path:
+		expected := specifier.Path
+		if !caseSensitive {
+			expected = strings.ToLower(expected)
+		}
+		if comparedPath != expected {
+			return fmt.Sprintf("path %s is not %s", path, specifier.Path)
+		}
+	case *route.RouteMatch_Regex:
+		if !fullMatch(specifier.Regex, path) {
+			return fmt.Sprintf("path %s does not match regex %s", path, specifier.Regex)
+		}
+	}
+
+	for _, matcher := range match.Headers {
+		if reason := headerMismatch(matcher, request); reason != "" {
+			return reason
+		}
+	}
+
+	values, _ := url.ParseQuery(query)
+	for _, matcher := range match.QueryParameters {
+		if _, ok := values[matcher.Name]; !ok {
+			return fmt.Sprintf("query parameter %s is missing", matcher.Name)
+		}
+		value := values.Get(matcher.Name)
+		switch {
+		case matcher.Value == "":
+		case matcher.Regex != nil && matcher.Regex.Value:
+			if !fullMatch(matcher.Value, value) {
+				return fmt.Sprintf("query parameter %s=%s does not match regex %s", matcher.Name, value, matcher.Value)
+			}
+		case value != matcher.Value:
+			return fmt.Sprintf("query parameter %s=%s is not %s", matcher.Name, value, matcher.Value)
+		}
+	}
+	return ""
+}
+
+func headerMismatch(matcher *route.HeaderMatcher, request *SimulatedRequest) string {
+	value, present := request.header(matcher.Name)
+	var matched bool
+	var expect string
+	switch specifier := matcher.HeaderMatchSpecifier.(type) {
+	case *route.HeaderMatcher_ExactMatch:
+		matched = present && value == specifier.ExactMatch
+		expect = "= " + specifier.ExactMatch
+	case *route.HeaderMatcher_RegexMatch:
+		matched = present && fullMatch(specifier.RegexMatch, value)
+		expect = "~ " + specifier.RegexMatch
+	case *route.HeaderMatcher_PrefixMatch:
+		matched = present && strings.HasPrefix(value, specifier.PrefixMatch)
+		expect = "starts with " + specifier.PrefixMatch
+	case *route.HeaderMatcher_SuffixMatch:
+		matched = present && strings.HasSuffix(value, specifier.SuffixMatch)
+		expect = "ends with " + specifier.SuffixMatch
+	case *route.HeaderMatcher_PresentMatch:
+		matched = present == specifier.PresentMatch
+		expect = fmt.Sprintf("present=%v", specifier.PresentMatch)
+	case *route.HeaderMatcher_RangeMatch:
+		number, err := strconv.ParseInt(value, 10, 64)
+		matched = present && err == nil && number >= specifier.RangeMatch.Start && number < specifier.RangeMatch.End
+		expect = fmt.Sprintf("in [%d, %d)", specifier.RangeMatch.Start, specifier.RangeMatch.End)
+	default:
+		matched = present
+		expect = "present"
+	}
+	if matcher.InvertMatch {
+		matched = !matched
+		expect = "not " + expect
+	}
+	if matched {
+		return ""
+	}
+	if !present {
+		return fmt.Sprintf("header %s is missing, expect %s", matcher.Name, expect)
+	}
+	return fmt.Sprintf("header %s=%s, expect %s", matcher.Name, value, expect)
+}
+
+type weightedCluster struct {
+	name string
+	//fraction of the requests of the route
+	share float64
+}
+
+func (simulation *Simulation) routeClusters(r *route.Route, request *SimulatedRequest) ([]weightedCluster, error) {
+	if redirect := r.GetRedirect(); redirect != nil {
+		simulation.explain("action: redirect %s", proto.CompactTextString(redirect))
+		return nil, nil
+	}
+	if response := r.GetDirectResponse(); response != nil {
+		simulation.explain("action: direct response with status %d", response.Status)
+		return nil, nil
+	}
+	action := r.GetRoute()
+	if action == nil {
+		return nil, fmt.Errorf("route has no action")
+	}
+	if cluster := action.GetCluster(); cluster != "" {
+		simulation.explain("action: all requests go to cluster %s", cluster)
+		return []weightedCluster{{name: cluster, share: 1}}, nil
+	}
+	if header := action.GetClusterHeader(); header != "" {
+		cluster, ok := request.header(header)
+		if !ok {
+			return nil, fmt.Errorf("cluster header %s is missing, envoy returns 404", header)
+		}
+		simulation.explain("action: cluster %s is taken from header %s", cluster, header)
+		return []weightedCluster{{name: cluster, share: 1}}, nil
+	}
+	weighted := action.GetWeightedClusters()
+	if weighted == nil {
+		return nil, fmt.Errorf("unsupported route action %s", proto.CompactTextString(action))
+	}
+	total := uint32(DEFAULT_ROUTE_TOTAL)
+	if weighted.TotalWeight != nil && weighted.TotalWeight.Value > 0 {
+		total = weighted.TotalWeight.Value
+	}
+	var result []weightedCluster
+	var parts []string
+	for _, cluster := range weighted.Clusters {
+		var weight uint32
+		if cluster.Weight != nil {
+			weight = cluster.Weight.Value
+		}
+		share := float64(weight) / float64(total)
+		parts = append(parts, fmt.Sprintf("%s %d/%d (%.1f%%)", cluster.Name, weight, total, share*100))
+		if weight > 0 {
+			result = append(result, weightedCluster{name: cluster.Name, share: share})
+		}
+	}
+	simulation.explain("action: weighted clusters %s", strings.Join(parts, ", "))
+	return result, nil
+}
+
+func (simulation *Simulation) findCluster(name string) *v2.Cluster {
+	for _, cluster := range simulation.Config.Clusters {
+		if cluster.Name == name {
+			return cluster
+		}
+	}
+	return nil
+}
+
+func (simulation *Simulation) findAssignment(cluster *v2.Cluster) *v2.ClusterLoadAssignment {
+	name := envoy.EndpointResourceName(cluster)
+	for _, assignment := range simulation.Config.Endpoints {
+		if assignment.ClusterName == name {
+			return assignment
+		}
+	}
+	return nil
+}
+
+// excludedHealthStatus are the EDS health status envoy does not route to.
+var excludedHealthStatus = map[core.HealthStatus]bool{
+	core.HealthStatus_UNHEALTHY: true,
+	core.HealthStatus_DRAINING:  true,
+	core.HealthStatus_TIMEOUT:   true,
+}
+
+func (simulation *Simulation) listEndpoints(clusters []weightedCluster) error {
+	for _, weighted := range clusters {
+		cluster := simulation.findCluster(weighted.name)
+		if cluster == nil {
+			simulation.explain("cluster %s: not received, envoy returns 503", weighted.name)
+			continue
+		}
+		var localities []endpoint.LocalityLbEndpoints
+		switch cluster.GetType() {
+		case v2.Cluster_ORIGINAL_DST:
+			simulation.explain("cluster %s (%s): forwarded to the original destination", cluster.Name, cluster.GetType())
+			continue
+		case v2.Cluster_EDS:
+			assignment := simulation.findAssignment(cluster)
+			if assignment == nil {
+				simulation.explain("cluster %s (%s): no endpoint assignment received, envoy returns 503", cluster.Name, cluster.GetType())
+				continue
+			}
+			simulation.explain("cluster %s (%s): endpoints of assignment %s", cluster.Name, cluster.GetType(), assignment.ClusterName)
+			localities = assignment.Endpoints
+		default:
+			if cluster.LoadAssignment != nil {
+				localities = cluster.LoadAssignment.Endpoints
+			} else {
+				var lbEndpoints []endpoint.LbEndpoint
+				for _, host := range cluster.Hosts {
+					lbEndpoints = append(lbEndpoints, endpoint.LbEndpoint{
+						HostIdentifier: &endpoint.LbEndpoint_Endpoint{Endpoint: &endpoint.Endpoint{Address: host}},
+					})
+				}
+				localities = []endpoint.LocalityLbEndpoints{{LbEndpoints: lbEndpoints}}
+			}
+			simulation.explain("cluster %s (%s): hosts of the cluster", cluster.Name, cluster.GetType())
+		}
+		simulation.printEndpoints(weighted.share, localities)
+	}
+	return nil
+}
+
+// printEndpoints lists the endpoints of the highest priority with healthy endpoints and their share
+// of the requests, the other priorities are only used on failover.
+func (simulation *Simulation) printEndpoints(share float64, localities []endpoint.LocalityLbEndpoints) {
+	type candidate struct {
+		address  string
+		weight   uint32
+		priority uint32
+		excluded string
+	}
+	var candidates []candidate
+	activePriority := ^uint32(0)
+	for _, locality := range localities {
+		for _, lbEndpoint := range locality.LbEndpoints {
+			host := lbEndpoint.GetEndpoint()
+			if host == nil || host.Address == nil {
+				continue
+			}
+			c := candidate{address: addressString(host.Address), weight: DEFAULT_LB_WEIGHT, priority: locality.Priority}
+			if lbEndpoint.LoadBalancingWeight != nil {
+				c.weight = lbEndpoint.LoadBalancingWeight.Value
+			}
+			if excludedHealthStatus[lbEndpoint.HealthStatus] {
+				c.excluded = "health status " + lbEndpoint.HealthStatus.String()
+			} else if c.priority < activePriority {
+				activePriority = c.priority
+			}
+			candidates = append(candidates, c)
+		}
+	}
+	var totalWeight uint32
+	for _, c := range candidates {
+		if c.excluded == "" && c.priority == activePriority {
+			totalWeight += c.weight
+		}
+	}
+	if totalWeight == 0 {
+		simulation.explain("  no healthy endpoint, envoy returns 503")
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		return candidates[i].address < candidates[j].address
+	})
+	for _, c := range candidates {
+		switch {
+		case c.excluded != "":
+			simulation.explain("  %s weight %d: excluded by %s", c.address, c.weight, c.excluded)
+		case c.priority != activePriority:
+			simulation.explain("  %s weight %d: priority %d is only used on failover", c.address, c.weight, c.priority)
+		default:
+			simulation.explain("  %s weight %d/%d: %.1f%% of the requests", c.address, c.weight, totalWeight,
+				share*float64(c.weight)/float64(totalWeight)*100)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	core "github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	discovery "github.com/envoyproxy/go-control-plane/envoy/service/discovery/v2"
+	"github.com/gogo/protobuf/proto"
+	"github.com/luguoxiang/envoy-demo/pkg/envoy"
+	"google.golang.org/grpc"
+)
+
+const DEFAULT_NODE_CLUSTER = "httpbin"
+
+var ResourceTypes = []string{
+	envoy.ListenerResource,
+	envoy.ClusterResource,
+	envoy.RouteResource,
+	envoy.EndpointResource,
+}
+
+// XdsClient talks to a control plane through one ADS stream as the given node.
+type XdsClient struct {
+	conn   *grpc.ClientConn
+	stream discovery.AggregatedDiscoveryService_StreamAggregatedResourcesClient
+	cancel context.CancelFunc
+	node   *core.Node
+}
+
+func NewXdsClient(serverAddr string, nodeId string) (*XdsClient, error) {
+	conn, err := grpc.Dial(serverAddr, grpc.WithInsecure())
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stream, err := discovery.NewAggregatedDiscoveryServiceClient(conn).StreamAggregatedResources(ctx)
+	if err != nil {
+		cancel()
+		conn.Close()
+		return nil, err
+	}
+	return &XdsClient{
+		conn:   conn,
+		stream: stream,
+		cancel: cancel,
+		node:   &core.Node{Id: nodeId, Cluster: DEFAULT_NODE_CLUSTER},
+	}, nil
+}
+
+func (client *XdsClient) Close() {
+	client.cancel()
+	client.conn.Close()
+}
+
+func (client *XdsClient) Send(typeUrl string, resourceNames []string, version string, nonce string) error {
+	return client.stream.Send(&v2.DiscoveryRequest{
+		Node:          client.node,
+		TypeUrl:       typeUrl,
+		ResourceNames: resourceNames,
+		VersionInfo:   version,
+		ResponseNonce: nonce,
+	})
+}
+
+func (client *XdsClient) Recv() (*v2.DiscoveryResponse, error) {
+	return client.stream.Recv()
+}
+
+// Fetch requests the named resources of typeUrl, all of them if resourceNames is empty,
+// and waits for the response. It must not be used concurrently with Watch.
+func (client *XdsClient) Fetch(typeUrl string, resourceNames []string) (*v2.DiscoveryResponse, error) {
+	if err := client.Send(typeUrl, resourceNames, "", ""); err != nil {
+		return nil, err
+	}
+	for {
+		resp, err := client.Recv()
+		if err != nil {
+			return nil, err
+		}
+		if resp.TypeUrl == typeUrl {
+			return resp, nil
+		}
+	}
+}
+
+// Watch subscribes typeUrl and calls handler with every pushed response, each of which is acked
+// with its version and nonce. It returns when the stream fails or handler returns an error.
+func (client *XdsClient) Watch(typeUrls []string, resourceNames []string, handler func(*v2.DiscoveryResponse) error) error {
+	for _, typeUrl := range typeUrls {
+		if err := client.Send(typeUrl, resourceNames, "", ""); err != nil {
+			return err
+		}
+	}
+	for {
+		resp, err := client.Recv()
+		if err != nil {
+			return err
+		}
+		if err := client.Send(resp.TypeUrl, resourceNames, resp.VersionInfo, resp.Nonce); err != nil {
+			return err
+		}
+		if err := handler(resp); err != nil {
+			return err
+		}
+	}
+}
+
+// DecodeResources unmarshals the resources of resp into their concrete types.
+func DecodeResources(resp *v2.DiscoveryResponse) ([]proto.Message, error) {
+	var result []proto.Message
+	for _, resource := range resp.Resources {
+		var message proto.Message
+		switch resp.TypeUrl {
+		case envoy.ListenerResource:
+			message = &v2.Listener{}
+		case envoy.ClusterResource:
+			message = &v2.Cluster{}
+		case envoy.RouteResource:
+			message = &v2.RouteConfiguration{}
+		case envoy.EndpointResource:
+			message = &v2.ClusterLoadAssignment{}
+		default:
+			return nil, fmt.Errorf("unknown type url %s", resp.TypeUrl)
+		}
+		if err := proto.Unmarshal(resource.Value, message); err != nil {
+			return nil, err
+		}
+		result = append(result, message)
+	}
+	return result, nil
+}
+
+func ResourceName(message proto.Message) string {
+	switch resource := message.(type) {
+	case *v2.Listener:
+		return resource.Name
+	case *v2.Cluster:
+		return resource.Name
+	case *v2.RouteConfiguration:
+		return resource.Name
+	case *v2.ClusterLoadAssignment:
+		return resource.ClusterName
+	}
+	return ""
+}
+
+// ShortTypeName returns e.g. Listener for envoy.ListenerResource.
+func ShortTypeName(typeUrl string) string {
+	for i := len(typeUrl) - 1; i >= 0; i-- {
+		if typeUrl[i] == '.' {
+			return typeUrl[i+1:]
+		}
+	}
+	return typeUrl
+}
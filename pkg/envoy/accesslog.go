@@ -0,0 +1,47 @@
+package envoy
+
+import (
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	als "github.com/envoyproxy/go-control-plane/envoy/config/accesslog/v2"
+	accesslog "github.com/envoyproxy/go-control-plane/envoy/config/filter/accesslog/v2"
+	"github.com/gogo/protobuf/proto"
+	"github.com/luguoxiang/envoy-demo/pkg/kubernetes"
+)
+
+func createAccessLog(name string, config proto.Message) *accesslog.AccessLog {
+	configStruct, err := MessageToStruct(config)
+	if err != nil {
+		panic(err.Error())
+	}
+	return &accesslog.AccessLog{
+		Name:       name,
+		ConfigType: &accesslog.AccessLog_Config{Config: configStruct},
+	}
+}
+
+// CreateAccessLogs returns the access logs of http connection managers configured by mesh config.
+func CreateAccessLogs(logName string) []*accesslog.AccessLog {
+	config := kubernetes.GetMeshConfig().AccessLog
+	var result []*accesslog.AccessLog
+	if config.File != "" {
+		result = append(result, createAccessLog(FileAccessLog, &als.FileAccessLog{
+			Path:   config.File,
+			Format: config.Format,
+		}))
+	}
+	if config.Grpc {
+		result = append(result, createAccessLog(HttpGrpcAccessLog, &als.HttpGrpcAccessLogConfig{
+			CommonConfig: &als.CommonGrpcAccessLogConfig{
+				LogName: logName,
+				GrpcService: &core.GrpcService{
+					TargetSpecifier: &core.GrpcService_EnvoyGrpc_{
+						EnvoyGrpc: &core.GrpcService_EnvoyGrpc{
+							ClusterName: ControlPlaneCluster,
+						},
+					},
+				},
+			},
+		}))
+	}
+	return result
+}
@@ -13,19 +13,48 @@ type AggregatedDiscoveryService struct {
 	eds *EndpointsDiscoveryService
 	lds *ListenersDiscoveryService
 	rds *RoutesDiscoveryService
+
+	Nodes *NodeTracker
 }
 
 func NewAggregatedDiscoveryService(cds *ClustersDiscoveryService,
 	eds *EndpointsDiscoveryService,
 	lds *ListenersDiscoveryService,
 	rds *RoutesDiscoveryService) *AggregatedDiscoveryService {
-	return &AggregatedDiscoveryService{
+	ads := &AggregatedDiscoveryService{
 		cds: cds, eds: eds, lds: lds, rds: rds,
+		Nodes: NewNodeTracker(),
 	}
+	cds.SetReferences(ads)
+	eds.SetReferences(ads)
+	lds.SetReferences(ads)
+	rds.SetReferences(ads)
+	return ads
+}
+
+// HasResource reports whether the discovery service of typeURL has the named resource.
+func (ads *AggregatedDiscoveryService) HasResource(typeURL string, name string) bool {
+	switch typeURL {
+	case EndpointResource:
+		return ads.eds.GetResource(name) != nil
+	case ClusterResource:
+		return ads.cds.GetResource(name) != nil
+	case RouteResource:
+		return ads.rds.GetResource(name) != nil
+	case ListenerResource:
+		return ads.lds.GetResource(name) != nil
+	}
+	return false
 }
 
 func (ads *AggregatedDiscoveryService) StreamAggregatedResources(stream discovery.AggregatedDiscoveryService_StreamAggregatedResourcesServer) error {
 	requestCh := make(chan *v2.DiscoveryRequest)
+	var node string
+	defer func() {
+		if node != "" {
+			ads.Nodes.Disconnected(node)
+		}
+	}()
 	go func() {
 		for {
 			req, err := stream.Recv()
@@ -50,6 +79,11 @@ func (ads *AggregatedDiscoveryService) StreamAggregatedResources(stream discover
 		if req == nil {
 			break
 		}
+		if node == "" {
+			node = req.Node.Id
+			ads.Nodes.Connected(node)
+		}
+		ads.Nodes.RequestReceived(req)
 		go func() {
 			var resp *v2.DiscoveryResponse
 			var err error
@@ -71,7 +105,12 @@ func (ads *AggregatedDiscoveryService) StreamAggregatedResources(stream discover
 				return
 			}
 			glog.Infof("Send %s, version=%s", req.TypeUrl, resp.VersionInfo)
-			stream.Send(resp)
+			//recorded before sending, the ack may be received before Send returns
+			ads.Nodes.ResponseSent(req.Node.Id, resp)
+			if err := stream.Send(resp); err != nil {
+				glog.Errorf("failed to send %s to %s: %s", req.TypeUrl, req.Node.Id, err.Error())
+				return
+			}
 		}()
 	}
 	return nil
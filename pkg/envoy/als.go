@@ -0,0 +1,300 @@
+package envoy
+
+import (
+	"encoding/json"
+	"fmt"
+	data "github.com/envoyproxy/go-control-plane/envoy/data/accesslog/v2"
+	accesslog "github.com/envoyproxy/go-control-plane/envoy/service/accesslog/v2"
+	"github.com/gogo/protobuf/jsonpb"
+	"github.com/golang/glog"
+	"github.com/luguoxiang/envoy-demo/pkg/kubernetes"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	//source and destination pairs kept in memory, the least recently logged one is evicted beyond it
+	AccessLogMaxKeys = 1000
+	//ips of the peers which could not be queried, their logs are missing from the response
+	AccessLogUnreachableHeader = "X-Envoy-Demo-Unreachable"
+	//set by peers to return only their own records
+	accessLogLocalParam  = "local"
+	accessLogPeerTimeout = 5 * time.Second
+)
+
+// AccessLogPeers returns the ips of the other control plane replicas.
+type AccessLogPeers func() ([]string, error)
+
+type AccessLogRecord struct {
+	Time        time.Time       `json:"time"`
+	Source      string          `json:"source"`
+	Destination string          `json:"destination"`
+	LogName     string          `json:"log_name"`
+	Entry       json.RawMessage `json:"entry"`
+}
+
+type accessLogRing struct {
+	records []*AccessLogRecord
+	next    int
+	updated time.Time
+}
+
+func (ring *accessLogRing) add(record *AccessLogRecord) {
+	ring.updated = record.Time
+	if len(ring.records) < cap(ring.records) {
+		ring.records = append(ring.records, record)
+	} else {
+		ring.records[ring.next] = record
+	}
+	ring.next = (ring.next + 1) % cap(ring.records)
+}
+
+// list returns records from the oldest to the newest.
+func (ring *accessLogRing) list() []*AccessLogRecord {
+	if len(ring.records) < cap(ring.records) {
+		return ring.records
+	}
+	var result []*AccessLogRecord
+	result = append(result, ring.records[ring.next:]...)
+	return append(result, ring.records[:ring.next]...)
+}
+
+type accessLogKey struct {
+	source      string
+	destination string
+}
+
+// AccessLogService receives http access logs from envoy sidecars and keeps the latest
+// records of each source node and destination cluster in memory. Sidecars stream to any replica
+// of the control plane, so queries are merged with the records of the peers.
+type AccessLogService struct {
+	peers      AccessLogPeers
+	client     *http.Client
+	mutex      sync.RWMutex
+	rings      map[accessLogKey]*accessLogRing
+	bufferSize int
+	writer     io.Writer
+	marshaler  *jsonpb.Marshaler
+}
+
+func NewAccessLogService(bufferSize int, logFile string) (*AccessLogService, error) {
+	if bufferSize <= 0 {
+		return nil, fmt.Errorf("invalid access log buffer size %d", bufferSize)
+	}
+	result := &AccessLogService{
+		client:     &http.Client{Timeout: accessLogPeerTimeout},
+		rings:      make(map[accessLogKey]*accessLogRing),
+		bufferSize: bufferSize,
+		marshaler:  &jsonpb.Marshaler{OrigName: true},
+	}
+	if logFile != "" {
+		file, err := os.OpenFile(logFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+		result.writer = file
+	}
+	return result, nil
+}
+
+// SetPeers makes queries include the records of the other replicas, peers may be nil.
+func (service *AccessLogService) SetPeers(peers AccessLogPeers) {
+	service.peers = peers
+}
+
+func (service *AccessLogService) StreamAccessLogs(stream accesslog.AccessLogService_StreamAccessLogsServer) error {
+	var source, logName string
+	for {
+		msg, err := stream.Recv()
+		if err == io.EOF {
+			return stream.SendAndClose(&accesslog.StreamAccessLogsResponse{})
+		}
+		if err != nil {
+			glog.Errorf("access log stream of %s failed: %s", source, err.Error())
+			return err
+		}
+		//only the first message of a stream carries the identifier
+		if msg.Identifier != nil {
+			if msg.Identifier.Node != nil {
+				source = msg.Identifier.Node.Id
+			}
+			logName = msg.Identifier.LogName
+		}
+		httpLogs := msg.GetHttpLogs()
+		if httpLogs == nil {
+			continue
+		}
+		for _, entry := range httpLogs.LogEntry {
+			service.addEntry(source, logName, entry)
+		}
+	}
+}
+
+func (service *AccessLogService) addEntry(source string, logName string, entry *data.HTTPAccessLogEntry) {
+	entryJson, err := service.marshaler.MarshalToString(entry)
+	if err != nil {
+		glog.Errorf("failed to marshal access log entry: %s", err.Error())
+		return
+	}
+	record := &AccessLogRecord{
+		Time:        time.Now(),
+		Source:      source,
+		Destination: entry.GetCommonProperties().GetUpstreamCluster(),
+		LogName:     logName,
+		Entry:       json.RawMessage(entryJson),
+	}
+	key := accessLogKey{source: record.Source, destination: record.Destination}
+
+	service.mutex.Lock()
+	defer service.mutex.Unlock()
+
+	ring := service.rings[key]
+	if ring == nil {
+		if len(service.rings) >= AccessLogMaxKeys {
+			service.evictOldest()
+		}
+		ring = &accessLogRing{records: make([]*AccessLogRecord, 0, service.bufferSize)}
+		service.rings[key] = ring
+	}
+	ring.add(record)
+
+	if service.writer != nil {
+		line, err := json.Marshal(record)
+		if err == nil {
+			_, err = service.writer.Write(append(line, '\n'))
+		}
+		if err != nil {
+			glog.Errorf("failed to write access log: %s", err.Error())
+		}
+	}
+}
+
+// evictOldest removes the records of the source and destination logged least recently, mutex must be held.
+func (service *AccessLogService) evictOldest() {
+	var oldest *accessLogKey
+	var oldestTime time.Time
+	for key, ring := range service.rings {
+		if oldest == nil || ring.updated.Before(oldestTime) {
+			k := key
+			oldest = &k
+			oldestTime = ring.updated
+		}
+	}
+	if oldest != nil {
+		delete(service.rings, *oldest)
+	}
+}
+
+// Query returns at most limit latest records, empty source or destination matches all.
+func (service *AccessLogService) Query(source string, destination string, limit int) []*AccessLogRecord {
+	service.mutex.RLock()
+	defer service.mutex.RUnlock()
+
+	var result []*AccessLogRecord
+	for key, ring := range service.rings {
+		if source != "" && key.source != source {
+			continue
+		}
+		if destination != "" && key.destination != destination {
+			continue
+		}
+		result = append(result, ring.list()...)
+	}
+	return mergeRecords(result, limit)
+}
+
+func (service *AccessLogService) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+	limit := 0
+	if value := query.Get("limit"); value != "" {
+		var err error
+		limit, err = strconv.Atoi(value)
+		if err != nil {
+			http.Error(resp, fmt.Sprintf("invalid limit %s", value), http.StatusBadRequest)
+			return
+		}
+	}
+	records := service.Query(query.Get("source"), query.Get("destination"), limit)
+	if query.Get(accessLogLocalParam) == "" && service.peers != nil {
+		peerRecords, unreachable := service.queryPeers(query)
+		records = mergeRecords(append(records, peerRecords...), limit)
+		if len(unreachable) > 0 {
+			resp.Header().Set(AccessLogUnreachableHeader, strings.Join(unreachable, ","))
+		}
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(resp).Encode(records); err != nil {
+		glog.Errorf("Can't write access logs: %v", err)
+	}
+}
+
+// queryPeers returns the local records of every peer and the peers which could not be queried.
+func (service *AccessLogService) queryPeers(query url.Values) ([]*AccessLogRecord, []string) {
+	peers, err := service.peers()
+	if err != nil {
+		glog.Errorf("failed to list access log peers: %s", err.Error())
+		return nil, []string{"*"}
+	}
+	peerQuery := url.Values{}
+	for key, values := range query {
+		peerQuery[key] = values
+	}
+	peerQuery.Set(accessLogLocalParam, "true")
+
+	var mutex sync.Mutex
+	var wg sync.WaitGroup
+	var records []*AccessLogRecord
+	var unreachable []string
+	for _, peer := range peers {
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+			peerRecords, err := service.queryPeer(peer, peerQuery)
+			mutex.Lock()
+			defer mutex.Unlock()
+			if err != nil {
+				glog.Errorf("failed to query access logs of %s: %s", peer, err.Error())
+				unreachable = append(unreachable, peer)
+				return
+			}
+			records = append(records, peerRecords...)
+		}(peer)
+	}
+	wg.Wait()
+	sort.Strings(unreachable)
+	return records, unreachable
+}
+
+func (service *AccessLogService) queryPeer(peer string, query url.Values) ([]*AccessLogRecord, error) {
+	resp, err := service.client.Get(fmt.Sprintf("http://%s:%d/accesslogs?%s", peer, kubernetes.DEBUG_PORT, query.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %s", resp.Status)
+	}
+	var records []*AccessLogRecord
+	if err := json.NewDecoder(resp.Body).Decode(&records); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// mergeRecords sorts records from the oldest to the newest and keeps at most limit latest ones.
+func mergeRecords(records []*AccessLogRecord, limit int) []*AccessLogRecord {
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].Time.Before(records[j].Time)
+	})
+	if limit > 0 && len(records) > limit {
+		records = records[len(records)-limit:]
+	}
+	return records
+}
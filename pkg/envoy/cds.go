@@ -7,7 +7,7 @@ import (
 	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
 	"github.com/gogo/protobuf/proto"
 	"github.com/luguoxiang/envoy-demo/pkg/kubernetes"
-	"time"
+	"sync"
 )
 
 type InboundClusterInfo struct {
@@ -28,15 +28,22 @@ func (info *InboundClusterInfo) Version() string {
 }
 
 type OutboundClusterInfo struct {
-	App  string
-	Port uint32
+	App    string
+	Port   uint32
+	Subset string
 }
 
 func (info *OutboundClusterInfo) Name() string {
+	if info.Subset != "" {
+		return fmt.Sprintf("outbound|%s:%d|%s", info.App, info.Port, info.Subset)
+	}
 	return fmt.Sprintf("outbound|%s:%d", info.App, info.Port)
 }
 
 func (info *OutboundClusterInfo) String() string {
+	if info.Subset != "" {
+		return fmt.Sprintf("OutboundCluster|%s:%d|%s", info.App, info.Port, info.Subset)
+	}
 	return fmt.Sprintf("OutboundCluster|%s:%d", info.App, info.Port)
 }
 
@@ -44,31 +51,92 @@ func (info *OutboundClusterInfo) Version() string {
 	return "1"
 }
 
+type ControlPlaneClusterInfo struct {
+}
+
+func (info *ControlPlaneClusterInfo) Name() string {
+	return ControlPlaneCluster
+}
+
+func (info *ControlPlaneClusterInfo) String() string {
+	controlPlane := kubernetes.GetMeshConfig().ControlPlane
+	return fmt.Sprintf("ControlPlaneCluster|%s:%d", controlPlane.Service, controlPlane.Port)
+}
+
+func (info *ControlPlaneClusterInfo) Version() string {
+	return "1"
+}
+
 type ClustersDiscoveryService struct {
 	DiscoveryService
+	externalClusters map[string]bool
+	//a subset cluster is kept while pods of its version exist or a traffic split references it
+	subsetPods    map[string]map[string]bool
+	splitClusters map[string]bool
+	//serialize pod and traffic split watchers sharing subsetPods and splitClusters
+	updateMutex sync.Mutex
 }
 
 func NewClustersDiscoveryService() *ClustersDiscoveryService {
-	return &ClustersDiscoveryService{
+	result := &ClustersDiscoveryService{
 		DiscoveryService: NewDiscoveryService(),
+		externalClusters: make(map[string]bool),
+		subsetPods:       make(map[string]map[string]bool),
+		splitClusters:    make(map[string]bool),
 	}
+	result.UpdateResource(&PassthroughClusterInfo{})
+	result.UpdateResource(&ControlPlaneClusterInfo{})
+	return result
 }
 
 func (cds *ClustersDiscoveryService) updateResource(pod *kubernetes.PodInfo, remove bool) {
 	app := pod.App()
 
-	port := kubernetes.DemoAppSet[app]
+	port := kubernetes.AppPort(app)
 	if port == 0 || pod.PodIP == "" {
 		return
 	}
+	cds.updateMutex.Lock()
+	defer cds.updateMutex.Unlock()
+
 	outboundInfo := &OutboundClusterInfo{App: app, Port: port}
 	inboundInfo := &InboundClusterInfo{PodIP: pod.PodIP, Port: port}
 	if remove {
 		cds.RemoveResource(inboundInfo.Name())
 		//do not remove outbound cluster
+		cds.releaseSubset(pod)
 	} else {
 		cds.UpdateResource(inboundInfo)
 		cds.UpdateResource(outboundInfo)
+		if pod.Version() != "" {
+			subsetInfo := &OutboundClusterInfo{App: app, Port: port, Subset: pod.Version()}
+			if cds.subsetPods[subsetInfo.Name()] == nil {
+				cds.subsetPods[subsetInfo.Name()] = make(map[string]bool)
+			}
+			cds.subsetPods[subsetInfo.Name()][podKey(pod)] = true
+			cds.UpdateResource(subsetInfo)
+		}
+	}
+}
+
+func podKey(pod *kubernetes.PodInfo) string {
+	return fmt.Sprintf("%s/%s", pod.Namespace, pod.Name)
+}
+
+// releaseSubset drops pod from the subset cluster of its version, updateMutex must be held.
+func (cds *ClustersDiscoveryService) releaseSubset(pod *kubernetes.PodInfo) {
+	port := kubernetes.AppPort(pod.App())
+	if port == 0 || pod.Version() == "" {
+		return
+	}
+	subsetInfo := &OutboundClusterInfo{App: pod.App(), Port: port, Subset: pod.Version()}
+	name := subsetInfo.Name()
+	delete(cds.subsetPods[name], podKey(pod))
+	if len(cds.subsetPods[name]) == 0 {
+		delete(cds.subsetPods, name)
+		if !cds.splitClusters[name] {
+			cds.RemoveResource(name)
+		}
 	}
 }
 
@@ -83,9 +151,50 @@ func (cds *ClustersDiscoveryService) PodDeleted(pod *kubernetes.PodInfo) {
 	cds.updateResource(pod, true)
 }
 func (cds *ClustersDiscoveryService) PodUpdated(oldPod, newPod *kubernetes.PodInfo) {
+	if oldPod.Version() != newPod.Version() {
+		cds.updateMutex.Lock()
+		cds.releaseSubset(oldPod)
+		cds.updateMutex.Unlock()
+	}
 	cds.updateResource(newPod, false)
 }
 
+func (cds *ClustersDiscoveryService) ServiceEntriesChanged(entries []*kubernetes.ServiceEntryInfo) {
+	current := make(map[string]bool)
+	for _, info := range NewExternalClusterInfos(entries) {
+		current[info.Name()] = true
+		cds.UpdateResource(info)
+	}
+	for name := range cds.externalClusters {
+		if !current[name] {
+			cds.RemoveResource(name)
+		}
+	}
+	cds.externalClusters = current
+}
+
+func (cds *ClustersDiscoveryService) TrafficSplitsChanged(splits []*kubernetes.TrafficSplitInfo) {
+	cds.updateMutex.Lock()
+	defer cds.updateMutex.Unlock()
+
+	//make sure every subset referenced by routes exists
+	current := make(map[string]bool)
+	for _, split := range splits {
+		port := kubernetes.AppPort(split.Service)
+		for _, backend := range split.Backends {
+			subsetInfo := &OutboundClusterInfo{App: split.Service, Port: port, Subset: backend.Version}
+			current[subsetInfo.Name()] = true
+			cds.UpdateResource(subsetInfo)
+		}
+	}
+	for name := range cds.splitClusters {
+		if !current[name] && len(cds.subsetPods[name]) == 0 {
+			cds.RemoveResource(name)
+		}
+	}
+	cds.splitClusters = current
+}
+
 func (cds *ClustersDiscoveryService) StreamClusters(stream v2.ClusterDiscoveryService_StreamClustersServer) error {
 	return cds.ProcessStream(stream, cds.BuildResource)
 }
@@ -97,7 +206,8 @@ func (cds *ClustersDiscoveryService) FetchClusters(ctx context.Context, req *v2.
 func (cds *ClustersDiscoveryService) BuildResource(resourceMap map[string]EnvoyResource, version string, node *core.Node) (*v2.DiscoveryResponse, error) {
 	var clusters []proto.Message
 
-	connectionTimeout := time.Duration(60*1000) * time.Millisecond
+	config := kubernetes.GetMeshConfig()
+	connectionTimeout := config.ConnectTimeout
 
 	for _, resource := range resourceMap {
 		var serviceCluster *v2.Cluster
@@ -138,11 +248,38 @@ func (cds *ClustersDiscoveryService) BuildResource(resourceMap map[string]EnvoyR
 					},
 				},
 			}
+		case *ExternalClusterInfo:
+			serviceCluster = clusterInfo.CreateCluster(connectionTimeout)
+		case *PassthroughClusterInfo:
+			serviceCluster = clusterInfo.CreateCluster(connectionTimeout)
+		case *ControlPlaneClusterInfo:
+			serviceCluster = &v2.Cluster{
+				Name:           clusterInfo.Name(),
+				ConnectTimeout: connectionTimeout,
+				ClusterDiscoveryType: &v2.Cluster_Type{
+					Type: v2.Cluster_STRICT_DNS,
+				},
+				DnsLookupFamily:      v2.Cluster_V4_ONLY,
+				Http2ProtocolOptions: &core.Http2ProtocolOptions{},
+				Hosts: []*core.Address{
+					&core.Address{
+						Address: &core.Address_SocketAddress{
+							SocketAddress: &core.SocketAddress{
+								Protocol: core.TCP,
+								Address:  config.ControlPlane.Service,
+								PortSpecifier: &core.SocketAddress_PortValue{
+									PortValue: config.ControlPlane.Port,
+								},
+							},
+						},
+					},
+				},
+			}
 		default:
 			panic("wrong cluster info type")
 		}
 		clusters = append(clusters, serviceCluster)
 	}
 
-	return MakeResource(clusters, ClusterResource, version)
+	return cds.BuildResponse(clusters, ClusterResource, version)
 }
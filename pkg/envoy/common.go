@@ -9,10 +9,12 @@ import (
 	"github.com/gogo/protobuf/proto"
 	"github.com/gogo/protobuf/types"
 	"github.com/golang/glog"
+	"github.com/luguoxiang/envoy-demo/pkg/kubernetes"
 	"reflect"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 const (
@@ -23,6 +25,12 @@ const (
 	ListenerResource      = typePrefix + "Listener"
 	RouterHttpFilter      = "envoy.router"
 	HTTPConnectionManager = "envoy.http_connection_manager"
+	TCPProxy              = "envoy.tcp_proxy"
+	TLSInspector          = "envoy.listener.tls_inspector"
+	PassthroughCluster    = "PassthroughCluster"
+	ControlPlaneCluster   = "envoy_demo_control_plane"
+	FileAccessLog         = "envoy.file_access_log"
+	HttpGrpcAccessLog     = "envoy.http_grpc_access_log"
 )
 
 type EnvoyResource interface {
@@ -35,6 +43,12 @@ type DiscoveryService struct {
 	resourceMap map[string]EnvoyResource
 	mutex       *sync.RWMutex
 	cond        *sync.Cond
+	//bumped when resources must be rebuilt although no EnvoyResource changed, e.g. on mesh config changes
+	generation uint64
+	//resolves references to resources of other discovery services, may be nil
+	references ResourceLookup
+	//last logged validation warnings, to avoid logging them for every node
+	warnings *atomic.Value
 }
 
 func NewDiscoveryService() DiscoveryService {
@@ -44,9 +58,32 @@ func NewDiscoveryService() DiscoveryService {
 		resourceMap: map[string]EnvoyResource{},
 		mutex:       mutex,
 		cond:        sync.NewCond(mutex),
+		warnings:    &atomic.Value{},
 	}
 }
 
+func (ds *DiscoveryService) SetReferences(references ResourceLookup) {
+	ds.references = references
+}
+
+// BuildResponse validates resources before publishing them, invalid ones are refused with a ValidationError.
+// A state of the world response without a listener or cluster would make envoy delete it, so the whole
+// version is refused instead of leaving invalid resources out.
+func (ds *DiscoveryService) BuildResponse(resources []proto.Message, typeURL string, version string) (*v2.DiscoveryResponse, error) {
+	valid, result := ValidResources(typeURL, resources, ds.references)
+	warnings := strings.Join(result.Warnings, "\n")
+	if last, _ := ds.warnings.Load().(string); last != warnings {
+		ds.warnings.Store(warnings)
+		for _, warning := range result.Warnings {
+			glog.Warningf("%s %s", typeURL, warning)
+		}
+	}
+	if len(result.Errors) > 0 {
+		return nil, &ValidationError{TypeURL: typeURL, Errors: result.Errors}
+	}
+	return MakeResource(valid, typeURL, version)
+}
+
 func (ds *DiscoveryService) GetResource(name string) EnvoyResource {
 	ds.mutex.Lock()
 	defer ds.mutex.Unlock()
@@ -83,6 +120,20 @@ func (ds *DiscoveryService) UpdateResource(resource EnvoyResource) {
 	ds.cond.Broadcast()
 }
 
+// Refresh makes every node receive newly built resources.
+func (ds *DiscoveryService) Refresh() {
+	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
+
+	ds.generation++
+	glog.Infof("Refresh resources, generation=%d", ds.generation)
+	ds.cond.Broadcast()
+}
+
+func (ds *DiscoveryService) MeshConfigChanged(oldConfig, newConfig *kubernetes.MeshConfig) {
+	ds.Refresh()
+}
+
 type ResponseBuilder func(resourceMap map[string]EnvoyResource, version string, node *core.Node) (*v2.DiscoveryResponse, error)
 
 type stream interface {
@@ -111,7 +162,11 @@ func (ds *DiscoveryService) GetResources(resourceNames []string) (map[string]Env
 		}
 	}
 	sort.Strings(versions)
-	return requested, strings.Join(versions, ",")
+	version := strings.Join(versions, ",")
+	if ds.generation > 0 {
+		version = fmt.Sprintf("%s,generation=%d", version, ds.generation)
+	}
+	return requested, version
 }
 
 func (ds *DiscoveryService) FetchResource(req *v2.DiscoveryRequest, builder ResponseBuilder) (*v2.DiscoveryResponse, error) {
@@ -126,23 +181,28 @@ func (ds *DiscoveryService) FetchResource(req *v2.DiscoveryRequest, builder Resp
 
 func (ds *DiscoveryService) ProcessRequest(req *v2.DiscoveryRequest, builder ResponseBuilder) (*v2.DiscoveryResponse, error) {
 	ds.mutex.Lock()
+	defer ds.mutex.Unlock()
 
-	var currentVersion string
-	var resourceMap map[string]EnvoyResource
+	//version whose resources were refused, the node keeps its config until the next change
+	var refusedVersion string
 	for {
-		resourceMap, currentVersion = ds.GetResources(req.ResourceNames)
+		resourceMap, currentVersion := ds.GetResources(req.ResourceNames)
 
-		if currentVersion == req.VersionInfo {
+		if currentVersion == req.VersionInfo || currentVersion == refusedVersion {
 			glog.Infof("Waiting update on %s for %v, current version=%s", req.TypeUrl, req.ResourceNames, currentVersion)
 			ds.cond.Wait()
-		} else {
-			break
+			continue
 		}
-	}
 
-	ds.mutex.Unlock()
-
-	return builder(resourceMap, currentVersion, req.Node)
+		ds.mutex.Unlock()
+		resp, err := builder(resourceMap, currentVersion, req.Node)
+		ds.mutex.Lock()
+		if _, ok := err.(*ValidationError); !ok {
+			return resp, err
+		}
+		glog.Errorf("Refused to push version %s to %s: %s", currentVersion, req.Node.Id, err.Error())
+		refusedVersion = currentVersion
+	}
 }
 
 func (ds *DiscoveryService) ProcessStream(stream stream, builder ResponseBuilder) error {
@@ -209,3 +269,12 @@ func MessageToStruct(msg proto.Message) (*types.Struct, error) {
 
 	return pbs, nil
 }
+
+// StructToMessage is the reverse of MessageToStruct, fields unknown to msg are ignored.
+func StructToMessage(pbs *types.Struct, msg proto.Message) error {
+	buf := &bytes.Buffer{}
+	if err := (&jsonpb.Marshaler{OrigName: true}).Marshal(buf, pbs); err != nil {
+		return err
+	}
+	return (&jsonpb.Unmarshaler{AllowUnknownFields: true}).Unmarshal(buf, msg)
+}
@@ -11,26 +11,30 @@ import (
 	"github.com/luguoxiang/envoy-demo/pkg/kubernetes"
 	"sort"
 	"strings"
+	"sync"
 )
 
 type AssignmentInfo struct {
 	PodIP   string
 	Weight  uint32
 	Version string
+	//HEALTHY, or DRAINING for terminating and drained pods
+	HealthStatus core.HealthStatus
 }
 
 func (info *AssignmentInfo) String() string {
-	return fmt.Sprintf("%s|%d", info.PodIP, info.Weight)
+	return fmt.Sprintf("%s|%d|%s", info.PodIP, info.Weight, info.HealthStatus)
 }
 
 type EndpointInfo struct {
 	App         string
 	Port        uint32
+	Subset      string
 	Assignments map[string]*AssignmentInfo
 }
 
 func (info *EndpointInfo) Name() string {
-	cluster := OutboundClusterInfo{App: info.App, Port: info.Port}
+	cluster := OutboundClusterInfo{App: info.App, Port: info.Port, Subset: info.Subset}
 	return cluster.Name()
 }
 
@@ -39,6 +43,9 @@ func (info *EndpointInfo) String() string {
 	for _, assignment := range info.Assignments {
 		assignments = append(assignments, assignment.String())
 	}
+	if info.Subset != "" {
+		return fmt.Sprintf("Endpoint|%s:%d|%s|%s", info.App, info.Port, info.Subset, strings.Join(assignments, ","))
+	}
 	return fmt.Sprintf("Endpoint|%s:%d|%s", info.App, info.Port, strings.Join(assignments, ","))
 }
 
@@ -56,17 +63,32 @@ func (info *EndpointInfo) Version() string {
 
 type EndpointsDiscoveryService struct {
 	DiscoveryService
+	//subsets referenced by traffic splits, answered even without pods
+	splitSubsets map[string]bool
+	//serialize pod and traffic split watchers sharing splitSubsets
+	updateMutex sync.Mutex
 }
 
 func NewEndpointsDiscoveryService() *EndpointsDiscoveryService {
 	return &EndpointsDiscoveryService{
 		DiscoveryService: NewDiscoveryService(),
+		splitSubsets:     make(map[string]bool),
 	}
 }
 func (eds *EndpointsDiscoveryService) updateResource(pod *kubernetes.PodInfo, remove bool) {
+	eds.updateMutex.Lock()
+	defer eds.updateMutex.Unlock()
+
+	eds.updateSubset(pod, "", remove)
+	if pod.Version() != "" {
+		eds.updateSubset(pod, pod.Version(), remove)
+	}
+}
+
+func (eds *EndpointsDiscoveryService) updateSubset(pod *kubernetes.PodInfo, subset string, remove bool) {
 	app := pod.App()
 
-	port := kubernetes.DemoAppSet[app]
+	port := kubernetes.AppPort(app)
 	if port == 0 || pod.PodIP == "" {
 		return
 	}
@@ -74,6 +96,7 @@ func (eds *EndpointsDiscoveryService) updateResource(pod *kubernetes.PodInfo, re
 	info := &EndpointInfo{
 		App:         app,
 		Port:        port,
+		Subset:      subset,
 		Assignments: map[string]*AssignmentInfo{},
 	}
 	resource := eds.GetResource(info.Name())
@@ -86,15 +109,28 @@ func (eds *EndpointsDiscoveryService) updateResource(pod *kubernetes.PodInfo, re
 		return
 	}
 
-	if remove {
+	//draining pods are kept so that envoy stops sending new requests but lets the current ones finish,
+	//pods which are not ready yet are left out instead of being marked unhealthy, so that envoy does not
+	//fall back to them in panic mode while a deployment starts
+	if remove || (!pod.Ready && !pod.Draining()) {
 		delete(info.Assignments, pod.PodIP)
 	} else {
+		healthStatus := core.HealthStatus_HEALTHY
+		if pod.Draining() {
+			healthStatus = core.HealthStatus_DRAINING
+		}
 		info.Assignments[pod.PodIP] = &AssignmentInfo{
-			PodIP:   pod.PodIP,
-			Weight:  pod.Weight(),
-			Version: pod.ResourceVersion,
+			PodIP:        pod.PodIP,
+			Weight:       pod.Weight(),
+			Version:      pod.ResourceVersion,
+			HealthStatus: healthStatus,
 		}
 	}
+	//the subset cluster is removed with the last pod of its version, see ClustersDiscoveryService
+	if remove && subset != "" && len(info.Assignments) == 0 && !eds.splitSubsets[info.Name()] {
+		eds.RemoveResource(info.Name())
+		return
+	}
 	eds.UpdateResource(info)
 
 }
@@ -112,9 +148,45 @@ func (eds *EndpointsDiscoveryService) PodDeleted(pod *kubernetes.PodInfo) {
 }
 
 func (eds *EndpointsDiscoveryService) PodUpdated(oldPod, newPod *kubernetes.PodInfo) {
+	if oldPod.Version() != "" && oldPod.Version() != newPod.Version() {
+		eds.updateMutex.Lock()
+		eds.updateSubset(oldPod, oldPod.Version(), true)
+		eds.updateMutex.Unlock()
+	}
 	eds.updateResource(newPod, false)
 }
 
+func (eds *EndpointsDiscoveryService) TrafficSplitsChanged(splits []*kubernetes.TrafficSplitInfo) {
+	eds.updateMutex.Lock()
+	defer eds.updateMutex.Unlock()
+
+	//answer subset clusters without pods with empty assignments
+	current := make(map[string]bool)
+	for _, split := range splits {
+		for _, backend := range split.Backends {
+			info := &EndpointInfo{
+				App:         split.Service,
+				Port:        kubernetes.AppPort(split.Service),
+				Subset:      backend.Version,
+				Assignments: map[string]*AssignmentInfo{},
+			}
+			current[info.Name()] = true
+			if eds.GetResource(info.Name()) == nil {
+				eds.UpdateResource(info)
+			}
+		}
+	}
+	for name := range eds.splitSubsets {
+		if current[name] {
+			continue
+		}
+		if info, ok := eds.GetResource(name).(*EndpointInfo); ok && len(info.Assignments) == 0 {
+			eds.RemoveResource(name)
+		}
+	}
+	eds.splitSubsets = current
+}
+
 func (ds *EndpointsDiscoveryService) StreamEndpoints(stream v2.EndpointDiscoveryService_StreamEndpointsServer) error {
 	return ds.ProcessStream(stream, ds.BuildResource)
 }
@@ -155,6 +227,7 @@ func (ds *EndpointsDiscoveryService) BuildResource(resourceMap map[string]EnvoyR
 						},
 					},
 				},
+				HealthStatus: assignment.HealthStatus,
 				LoadBalancingWeight: &types.UInt32Value{
 					Value: assignment.Weight,
 				},
@@ -167,5 +240,5 @@ func (ds *EndpointsDiscoveryService) BuildResource(resourceMap map[string]EnvoyR
 		claList = append(claList, cla)
 	}
 
-	return MakeResource(claList, EndpointResource, version)
+	return ds.BuildResponse(claList, EndpointResource, version)
 }
@@ -0,0 +1,286 @@
+package envoy
+
+import (
+	"fmt"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/listener"
+	tcp "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/tcp_proxy/v2"
+	types "github.com/gogo/protobuf/types"
+	"github.com/golang/glog"
+	"github.com/luguoxiang/envoy-demo/pkg/kubernetes"
+	"sort"
+	"strings"
+	"time"
+)
+
+type ExternalClusterInfo struct {
+	Host            string
+	Port            uint32
+	Resolution      string
+	Endpoints       []string
+	ResourceVersion string
+}
+
+func (info *ExternalClusterInfo) Name() string {
+	cluster := OutboundClusterInfo{App: info.Host, Port: info.Port}
+	return cluster.Name()
+}
+
+func (info *ExternalClusterInfo) String() string {
+	return fmt.Sprintf("ExternalCluster|%s:%d|%s", info.Host, info.Port, info.Resolution)
+}
+
+func (info *ExternalClusterInfo) Version() string {
+	return info.ResourceVersion
+}
+
+func (info *ExternalClusterInfo) CreateCluster(connectionTimeout time.Duration) *v2.Cluster {
+	endpoints := info.Endpoints
+	discoveryType := v2.Cluster_STATIC
+	if info.Resolution == kubernetes.RESOLUTION_DNS {
+		if len(endpoints) == 0 {
+			discoveryType = v2.Cluster_LOGICAL_DNS
+			endpoints = []string{fmt.Sprintf("%s:%d", info.Host, info.Port)}
+		} else {
+			discoveryType = v2.Cluster_STRICT_DNS
+		}
+	}
+
+	var hosts []*core.Address
+	for _, endpoint := range endpoints {
+		address, port := splitHostPort(endpoint, info.Port)
+		hosts = append(hosts, &core.Address{
+			Address: &core.Address_SocketAddress{
+				SocketAddress: &core.SocketAddress{
+					Protocol: core.TCP,
+					Address:  address,
+					PortSpecifier: &core.SocketAddress_PortValue{
+						PortValue: port,
+					},
+				},
+			},
+		})
+	}
+	return &v2.Cluster{
+		Name:           info.Name(),
+		ConnectTimeout: connectionTimeout,
+		ClusterDiscoveryType: &v2.Cluster_Type{
+			Type: discoveryType,
+		},
+		DnsLookupFamily: v2.Cluster_V4_ONLY,
+		Hosts:           hosts,
+	}
+}
+
+type PassthroughClusterInfo struct {
+}
+
+func (info *PassthroughClusterInfo) Name() string {
+	return PassthroughCluster
+}
+
+func (info *PassthroughClusterInfo) String() string {
+	return PassthroughCluster
+}
+
+func (info *PassthroughClusterInfo) Version() string {
+	return "1"
+}
+
+func (info *PassthroughClusterInfo) CreateCluster(connectionTimeout time.Duration) *v2.Cluster {
+	return &v2.Cluster{
+		Name:           info.Name(),
+		ConnectTimeout: connectionTimeout,
+		ClusterDiscoveryType: &v2.Cluster_Type{
+			Type: v2.Cluster_ORIGINAL_DST,
+		},
+		LbPolicy: v2.Cluster_ORIGINAL_DST_LB,
+	}
+}
+
+type ExternalChainInfo struct {
+	Host      string
+	Port      uint32
+	SNI       bool
+	Addresses []string
+}
+
+type ExternalListenerInfo struct {
+	Port            uint32
+	Chains          []*ExternalChainInfo
+	ResourceVersion string
+}
+
+func (info *ExternalListenerInfo) Name() string {
+	return fmt.Sprintf("ExternalListener|%d", info.Port)
+}
+
+func (info *ExternalListenerInfo) String() string {
+	var hosts []string
+	for _, chain := range info.Chains {
+		hosts = append(hosts, chain.Host)
+	}
+	return fmt.Sprintf("%s|%s", info.Name(), strings.Join(hosts, ","))
+}
+
+func (info *ExternalListenerInfo) Version() string {
+	return info.ResourceVersion
+}
+
+func (info *ExternalListenerInfo) CreateListener() *v2.Listener {
+	var filterChains []listener.FilterChain
+	var listenerFilters []listener.ListenerFilter
+	for _, chain := range info.Chains {
+		cluster := OutboundClusterInfo{App: chain.Host, Port: chain.Port}
+		filterConfig, err := MessageToStruct(&tcp.TcpProxy{
+			StatPrefix: cluster.Name(),
+			ClusterSpecifier: &tcp.TcpProxy_Cluster{
+				Cluster: cluster.Name(),
+			},
+		})
+		if err != nil {
+			panic(err.Error())
+		}
+		match := &listener.FilterChainMatch{}
+		if chain.SNI {
+			match.ServerNames = []string{chain.Host}
+		} else {
+			for _, address := range chain.Addresses {
+				match.PrefixRanges = append(match.PrefixRanges, &core.CidrRange{
+					AddressPrefix: address,
+					PrefixLen:     &types.UInt32Value{Value: 32},
+				})
+			}
+		}
+		filterChains = append(filterChains, listener.FilterChain{
+			FilterChainMatch: match,
+			Filters: []listener.Filter{{
+				Name:       TCPProxy,
+				ConfigType: &listener.Filter_Config{Config: filterConfig},
+			}},
+		})
+		if chain.SNI && len(listenerFilters) == 0 {
+			listenerFilters = append(listenerFilters, listener.ListenerFilter{
+				Name: TLSInspector,
+			})
+		}
+	}
+
+	return &v2.Listener{
+		Name: info.Name(),
+		Address: core.Address{
+			Address: &core.Address_SocketAddress{
+				SocketAddress: &core.SocketAddress{
+					Protocol: core.TCP,
+					Address:  "0.0.0.0",
+					PortSpecifier: &core.SocketAddress_PortValue{
+						PortValue: info.Port,
+					},
+				},
+			},
+		},
+		DeprecatedV1: &v2.Listener_DeprecatedV1{
+			BindToPort: &types.BoolValue{Value: false},
+		},
+		ListenerFilters: listenerFilters,
+		FilterChains:    filterChains,
+	}
+}
+
+func splitHostPort(endpoint string, defaultPort uint32) (string, uint32) {
+	index := strings.LastIndex(endpoint, ":")
+	if index < 0 {
+		return endpoint, defaultPort
+	}
+	port := kubernetes.GetLabelValueUInt32(endpoint[index+1:])
+	if port == 0 {
+		return endpoint, defaultPort
+	}
+	return endpoint[:index], port
+}
+
+// NewExternalClusterInfos flattens service entries into one cluster per host and port.
+func NewExternalClusterInfos(entries []*kubernetes.ServiceEntryInfo) []*ExternalClusterInfo {
+	var result []*ExternalClusterInfo
+	for _, entry := range entries {
+		for i := range entry.Ports {
+			port := &entry.Ports[i]
+			var endpoints []string
+			for j := range entry.Endpoints {
+				endpoint := &entry.Endpoints[j]
+				endpoints = append(endpoints, fmt.Sprintf("%s:%d", endpoint.Address, entry.EndpointPort(endpoint, port)))
+			}
+			for _, host := range entry.Hosts {
+				result = append(result, &ExternalClusterInfo{
+					Host:            host,
+					Port:            port.Number,
+					Resolution:      entry.Resolution,
+					Endpoints:       endpoints,
+					ResourceVersion: entry.ResourceVersion,
+				})
+			}
+		}
+	}
+	return result
+}
+
+// NewExternalListenerInfos groups TLS and TCP service entry ports into one listener per port.
+// HTTP ports are served by OutboundListenerInfo and RDS instead.
+func NewExternalListenerInfos(entries []*kubernetes.ServiceEntryInfo) map[uint32]*ExternalListenerInfo {
+	result := make(map[uint32]*ExternalListenerInfo)
+	versions := make(map[uint32][]string)
+	for _, entry := range entries {
+		for i := range entry.Ports {
+			port := &entry.Ports[i]
+			if port.IsHTTP() {
+				continue
+			}
+			var chains []*ExternalChainInfo
+			if port.IsTLS() {
+				for _, host := range entry.Hosts {
+					chains = append(chains, &ExternalChainInfo{Host: host, Port: port.Number, SNI: true})
+				}
+			} else if entry.Resolution == kubernetes.RESOLUTION_STATIC && len(entry.Hosts) == 1 {
+				var addresses []string
+				for _, endpoint := range entry.Endpoints {
+					addresses = append(addresses, endpoint.Address)
+				}
+				chains = append(chains, &ExternalChainInfo{Host: entry.Hosts[0], Port: port.Number, Addresses: addresses})
+			} else {
+				glog.Warningf("Ignore tcp port %d of %s, only STATIC entries with one host are supported", port.Number, entry.String())
+				continue
+			}
+			info := result[port.Number]
+			if info == nil {
+				info = &ExternalListenerInfo{Port: port.Number}
+				result[port.Number] = info
+			}
+			info.Chains = append(info.Chains, chains...)
+			versions[port.Number] = append(versions[port.Number], entry.ResourceVersion)
+		}
+	}
+	for port, info := range result {
+		sort.Strings(versions[port])
+		info.ResourceVersion = strings.Join(versions[port], "-")
+	}
+	return result
+}
+
+// NewExternalRouteHosts returns the external HTTP hosts per port.
+func NewExternalRouteHosts(entries []*kubernetes.ServiceEntryInfo) map[uint32][]string {
+	result := make(map[uint32][]string)
+	for _, entry := range entries {
+		for i := range entry.Ports {
+			port := &entry.Ports[i]
+			if !port.IsHTTP() {
+				continue
+			}
+			result[port.Number] = append(result[port.Number], entry.Hosts...)
+		}
+	}
+	for _, hosts := range result {
+		sort.Strings(hosts)
+	}
+	return result
+}
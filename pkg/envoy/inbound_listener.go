@@ -14,6 +14,7 @@ type InboundListenerInfo struct {
 	PodIP   string
 	Port    uint32
 	PodName string
+	App     string
 }
 
 func (info *InboundListenerInfo) Name() string {
@@ -58,12 +59,11 @@ func (info *InboundListenerInfo) CreateListener() *v2.Listener {
 				},
 			},
 		},
-		Tracing: &hcm.HttpConnectionManager_Tracing{
-			OperationName: hcm.INGRESS,
-		},
+		Tracing: CreateTracing(hcm.INGRESS, info.App),
 		HttpFilters: []*hcm.HttpFilter{{
 			Name: RouterHttpFilter,
 		}},
+		AccessLog: CreateAccessLogs("inbound"),
 	}
 
 	filterConfig, err := MessageToStruct(manager)
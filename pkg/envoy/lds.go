@@ -7,35 +7,54 @@ import (
 	"github.com/envoyproxy/go-control-plane/envoy/api/v2/listener"
 	"github.com/envoyproxy/go-control-plane/envoy/api/v2/route"
 	hcm "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/http_connection_manager/v2"
+	tcp "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/tcp_proxy/v2"
 	"github.com/gogo/protobuf/proto"
 	types "github.com/gogo/protobuf/types"
+	"github.com/golang/glog"
 	"github.com/luguoxiang/envoy-demo/pkg/kubernetes"
+	"sync"
 )
 
 type ListenersDiscoveryService struct {
 	DiscoveryService
+	externalListeners map[string]bool
+	//outbound listeners added for the http ports of service entries
+	entryListeners map[string]bool
+	//serialize pod and service entry watchers sharing externalListeners
+	updateMutex sync.Mutex
 }
 
 func NewListenersDiscoveryService() *ListenersDiscoveryService {
 	return &ListenersDiscoveryService{
-		DiscoveryService: NewDiscoveryService(),
+		DiscoveryService:  NewDiscoveryService(),
+		externalListeners: make(map[string]bool),
+		entryListeners:    make(map[string]bool),
 	}
 }
 
 func (lds *ListenersDiscoveryService) updateResource(pod *kubernetes.PodInfo, remove bool) {
 	app := pod.App()
 
-	port := kubernetes.DemoAppSet[app]
+	port := kubernetes.AppPort(app)
 	if port == 0 {
 		return
 	}
+	lds.updateMutex.Lock()
+	defer lds.updateMutex.Unlock()
 
 	outboundInfo := &OutboundListenerInfo{Port: port}
-	inboundInfo := &InboundListenerInfo{PodIP: pod.PodIP, Port: port, PodName: pod.Name}
+	inboundInfo := &InboundListenerInfo{PodIP: pod.PodIP, Port: port, PodName: pod.Name, App: app}
 	if remove {
 		lds.RemoveResource(inboundInfo.Name())
 		//do not remove outbound listener
 	} else {
+		//http services win over tcp service entries on the same port, as in ServiceEntriesChanged
+		externalInfo := &ExternalListenerInfo{Port: port}
+		if lds.externalListeners[externalInfo.Name()] {
+			glog.Warningf("Remove %s, port %d is now used by http service %s", externalInfo.Name(), port, app)
+			lds.RemoveResource(externalInfo.Name())
+			delete(lds.externalListeners, externalInfo.Name())
+		}
 		lds.UpdateResource(inboundInfo)
 		lds.UpdateResource(outboundInfo)
 	}
@@ -54,6 +73,49 @@ func (lds *ListenersDiscoveryService) PodDeleted(pod *kubernetes.PodInfo) {
 func (lds *ListenersDiscoveryService) PodUpdated(oldPod, newPod *kubernetes.PodInfo) {
 	lds.updateResource(newPod, false)
 }
+func (lds *ListenersDiscoveryService) ServiceEntriesChanged(entries []*kubernetes.ServiceEntryInfo) {
+	lds.updateMutex.Lock()
+	defer lds.updateMutex.Unlock()
+
+	appPorts := make(map[uint32]bool)
+	for _, port := range kubernetes.GetMeshConfig().Apps {
+		appPorts[port] = true
+	}
+	currentOutbound := make(map[string]bool)
+	for port := range NewExternalRouteHosts(entries) {
+		outboundInfo := &OutboundListenerInfo{Port: port}
+		currentOutbound[outboundInfo.Name()] = true
+		lds.UpdateResource(outboundInfo)
+	}
+	for name := range lds.entryListeners {
+		if currentOutbound[name] {
+			continue
+		}
+		//the listener of an app port is kept, like in updateResource
+		if resource, ok := lds.GetResource(name).(*OutboundListenerInfo); ok && !appPorts[resource.Port] {
+			lds.RemoveResource(name)
+		}
+	}
+	lds.entryListeners = currentOutbound
+
+	current := make(map[string]bool)
+	for port, info := range NewExternalListenerInfos(entries) {
+		outboundInfo := &OutboundListenerInfo{Port: port}
+		if lds.GetResource(outboundInfo.Name()) != nil {
+			glog.Warningf("Ignore %s, port %d is already used by http services", info.String(), port)
+			continue
+		}
+		current[info.Name()] = true
+		lds.UpdateResource(info)
+	}
+	for name := range lds.externalListeners {
+		if !current[name] {
+			lds.RemoveResource(name)
+		}
+	}
+	lds.externalListeners = current
+}
+
 func (lds *ListenersDiscoveryService) StreamListeners(stream v2.ListenerDiscoveryService_StreamListenersServer) error {
 	return lds.ProcessStream(stream, lds.BuildResource)
 }
@@ -63,6 +125,52 @@ func (lds *ListenersDiscoveryService) FetchListeners(ctx context.Context, req *v
 }
 
 func (lds *ListenersDiscoveryService) CreateVirtualListener() *v2.Listener {
+	var filterChain listener.FilterChain
+	if kubernetes.GetMeshConfig().OutboundTrafficPolicy == kubernetes.OUTBOUND_ALLOW_ANY {
+		filterChain = lds.createPassthroughFilterChain()
+	} else {
+		filterChain = lds.createBlackholeFilterChain()
+	}
+
+	return &v2.Listener{
+		Name: "virtual",
+		Address: core.Address{
+			Address: &core.Address_SocketAddress{
+				SocketAddress: &core.SocketAddress{
+					Protocol: core.TCP,
+					Address:  "0.0.0.0",
+					PortSpecifier: &core.SocketAddress_PortValue{
+						PortValue: kubernetes.GetMeshConfig().Proxy.ListenPort,
+					},
+				},
+			},
+		},
+
+		UseOriginalDst: &types.BoolValue{Value: true},
+
+		FilterChains: []listener.FilterChain{filterChain},
+	}
+}
+
+func (lds *ListenersDiscoveryService) createPassthroughFilterChain() listener.FilterChain {
+	filterConfig, err := MessageToStruct(&tcp.TcpProxy{
+		StatPrefix: PassthroughCluster,
+		ClusterSpecifier: &tcp.TcpProxy_Cluster{
+			Cluster: PassthroughCluster,
+		},
+	})
+	if err != nil {
+		panic(err.Error())
+	}
+	return listener.FilterChain{
+		Filters: []listener.Filter{{
+			Name:       TCPProxy,
+			ConfigType: &listener.Filter_Config{Config: filterConfig},
+		}},
+	}
+}
+
+func (lds *ListenersDiscoveryService) createBlackholeFilterChain() listener.FilterChain {
 	manager := &hcm.HttpConnectionManager{
 		CodecType:  hcm.AUTO,
 		StatPrefix: "http",
@@ -93,36 +201,18 @@ func (lds *ListenersDiscoveryService) CreateVirtualListener() *v2.Listener {
 		HttpFilters: []*hcm.HttpFilter{{
 			Name: RouterHttpFilter,
 		}},
+		AccessLog: CreateAccessLogs("blackhole"),
 	}
 	filterConfig, err := MessageToStruct(manager)
 	if err != nil {
 		panic(err.Error())
 	}
-	filterChain := listener.FilterChain{
+	return listener.FilterChain{
 		Filters: []listener.Filter{{
 			Name:       HTTPConnectionManager,
 			ConfigType: &listener.Filter_Config{Config: filterConfig},
 		}},
 	}
-
-	return &v2.Listener{
-		Name: "virtual",
-		Address: core.Address{
-			Address: &core.Address_SocketAddress{
-				SocketAddress: &core.SocketAddress{
-					Protocol: core.TCP,
-					Address:  "0.0.0.0",
-					PortSpecifier: &core.SocketAddress_PortValue{
-						PortValue: kubernetes.ENVOY_LISTEN_PORT,
-					},
-				},
-			},
-		},
-
-		UseOriginalDst: &types.BoolValue{Value: true},
-
-		FilterChains: []listener.FilterChain{filterChain},
-	}
 }
 
 func (lds *ListenersDiscoveryService) BuildResource(resourceMap map[string]EnvoyResource, version string, node *core.Node) (*v2.DiscoveryResponse, error) {
@@ -135,11 +225,13 @@ func (lds *ListenersDiscoveryService) BuildResource(resourceMap map[string]Envoy
 			}
 		case *OutboundListenerInfo:
 			listeners = append(listeners, listenerInfo.CreateListener())
+		case *ExternalListenerInfo:
+			listeners = append(listeners, listenerInfo.CreateListener())
 		default:
 			panic("Unknown listener info")
 		}
 	}
 
 	listeners = append(listeners, lds.CreateVirtualListener())
-	return MakeResource(listeners, ListenerResource, version)
+	return lds.BuildResponse(listeners, ListenerResource, version)
 }
@@ -0,0 +1,178 @@
+package envoy
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/golang/glog"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+type NodeTypeStatus struct {
+	SentVersion  string    `json:"sent_version,omitempty"`
+	AckedVersion string    `json:"acked_version,omitempty"`
+	LastAckTime  time.Time `json:"last_ack_time,omitempty"`
+	LastError    string    `json:"last_error,omitempty"`
+}
+
+type NodeStatus struct {
+	Node        string                     `json:"node"`
+	ConnectTime time.Time                  `json:"connect_time"`
+	Types       map[string]*NodeTypeStatus `json:"types"`
+	//a reconnecting proxy may open the new stream before the old one is closed
+	streams int
+}
+
+// Ready returns whether the node has acked listeners and clusters at least once.
+func (status *NodeStatus) Ready() bool {
+	for _, typeUrl := range []string{ClusterResource, ListenerResource} {
+		typeStatus := status.Types[typeUrl]
+		if typeStatus == nil || typeStatus.AckedVersion == "" {
+			return false
+		}
+	}
+	return true
+}
+
+// NodeTracker records which versions of each resource type were sent to and acked by the
+// envoy nodes connected to this control plane.
+type NodeTracker struct {
+	mutex sync.RWMutex
+	nodes map[string]*NodeStatus
+}
+
+func NewNodeTracker() *NodeTracker {
+	return &NodeTracker{nodes: make(map[string]*NodeStatus)}
+}
+
+func (tracker *NodeTracker) typeStatus(node string, typeUrl string) *NodeTypeStatus {
+	status := tracker.nodes[node]
+	if status == nil {
+		//the stream is already closed
+		return &NodeTypeStatus{}
+	}
+	result := status.Types[typeUrl]
+	if result == nil {
+		result = &NodeTypeStatus{}
+		status.Types[typeUrl] = result
+	}
+	return result
+}
+
+// RequestReceived handles a discovery request, which acks the sent version or nacks it with ErrorDetail.
+func (tracker *NodeTracker) RequestReceived(req *v2.DiscoveryRequest) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	status := tracker.typeStatus(req.Node.Id, req.TypeUrl)
+	if req.ErrorDetail != nil {
+		status.LastError = req.ErrorDetail.Message
+		glog.Warningf("Node %s rejected %s version %s: %s", req.Node.Id, req.TypeUrl, status.SentVersion, status.LastError)
+		return
+	}
+	if req.VersionInfo != "" && req.VersionInfo == status.SentVersion {
+		status.AckedVersion = req.VersionInfo
+		status.LastAckTime = time.Now()
+		status.LastError = ""
+	}
+}
+
+func (tracker *NodeTracker) ResponseSent(node string, resp *v2.DiscoveryResponse) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	tracker.typeStatus(node, resp.TypeUrl).SentVersion = resp.VersionInfo
+}
+
+func (tracker *NodeTracker) Connected(node string) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	status := tracker.nodes[node]
+	if status == nil || status.streams == 0 {
+		//a restarted proxy is not ready until it acks again
+		status = &NodeStatus{
+			Node:        node,
+			ConnectTime: time.Now(),
+			Types:       make(map[string]*NodeTypeStatus),
+		}
+		tracker.nodes[node] = status
+	}
+	status.streams++
+}
+
+func (tracker *NodeTracker) Disconnected(node string) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+
+	status := tracker.nodes[node]
+	if status == nil {
+		return
+	}
+	status.streams--
+	if status.streams <= 0 {
+		delete(tracker.nodes, node)
+	}
+}
+
+func (tracker *NodeTracker) Get(node string) *NodeStatus {
+	tracker.mutex.RLock()
+	defer tracker.mutex.RUnlock()
+
+	status := tracker.nodes[node]
+	if status == nil {
+		return nil
+	}
+	result := *status
+	result.Types = make(map[string]*NodeTypeStatus)
+	for typeUrl, typeStatus := range status.Types {
+		copied := *typeStatus
+		result.Types[typeUrl] = &copied
+	}
+	return &result
+}
+
+func (tracker *NodeTracker) List() []*NodeStatus {
+	tracker.mutex.RLock()
+	var names []string
+	for name := range tracker.nodes {
+		names = append(names, name)
+	}
+	tracker.mutex.RUnlock()
+
+	sort.Strings(names)
+	var result []*NodeStatus
+	for _, name := range names {
+		if status := tracker.Get(name); status != nil {
+			result = append(result, status)
+		}
+	}
+	return result
+}
+
+// ServeHTTP answers /ready?node=, 200 if the node acked listeners and clusters, 503 otherwise.
+// Without node, the status of all nodes is returned.
+func (tracker *NodeTracker) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	resp.Header().Set("Content-Type", "application/json")
+	node := req.URL.Query().Get("node")
+	if node == "" {
+		if err := json.NewEncoder(resp).Encode(tracker.List()); err != nil {
+			glog.Errorf("Can't write node status: %v", err)
+		}
+		return
+	}
+	status := tracker.Get(node)
+	if status == nil {
+		http.Error(resp, fmt.Sprintf("node %s is not connected", node), http.StatusNotFound)
+		return
+	}
+	if !status.Ready() {
+		resp.WriteHeader(http.StatusServiceUnavailable)
+	}
+	if err := json.NewEncoder(resp).Encode(status); err != nil {
+		glog.Errorf("Can't write node status: %v", err)
+	}
+}
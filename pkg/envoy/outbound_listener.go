@@ -40,12 +40,11 @@ func (info *OutboundListenerInfo) CreateListener() *v2.Listener {
 			},
 		},
 
-		Tracing: &hcm.HttpConnectionManager_Tracing{
-			OperationName: hcm.EGRESS,
-		},
+		Tracing: CreateTracing(hcm.EGRESS, ""),
 		HttpFilters: []*hcm.HttpFilter{{
 			Name: RouterHttpFilter,
 		}},
+		AccessLog: CreateAccessLogs("outbound"),
 	}
 
 	filterConfig, err := MessageToStruct(manager)
@@ -7,12 +7,28 @@ import (
 	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
 	"github.com/envoyproxy/go-control-plane/envoy/api/v2/route"
 	"github.com/gogo/protobuf/proto"
+	"github.com/gogo/protobuf/types"
 	"github.com/luguoxiang/envoy-demo/pkg/kubernetes"
+	"sort"
+	"strings"
+	"sync"
 )
 
 type RouteInfo struct {
-	port  uint32
-	hosts []string
+	port            uint32
+	hosts           []string
+	externalHosts   []string
+	externalVersion string
+	splits          map[string][]kubernetes.TrafficSplitBackend
+	splitVersion    string
+	//host -> service cluster ip
+	clusterIPs       map[string]string
+	clusterIPVersion string
+}
+
+func (info *RouteInfo) clone() *RouteInfo {
+	result := *info
+	return &result
 }
 
 func (info *RouteInfo) Name() string {
@@ -24,21 +40,62 @@ func (info *RouteInfo) String() string {
 }
 
 func (info *RouteInfo) Version() string {
-	return fmt.Sprintf("%d", len(info.hosts))
+	result := fmt.Sprintf("%d", len(info.hosts))
+	if info.externalVersion != "" {
+		result = fmt.Sprintf("%s-%s", result, info.externalVersion)
+	}
+	if info.splitVersion != "" {
+		result = fmt.Sprintf("%s-%s", result, info.splitVersion)
+	}
+	if info.clusterIPVersion != "" {
+		result = fmt.Sprintf("%s-%s", result, info.clusterIPVersion)
+	}
+	return result
+}
+
+func (info *RouteInfo) createRouteAction(host string) *route.RouteAction {
+	backends := info.splits[host]
+	if len(backends) == 0 {
+		clusterInfo := OutboundClusterInfo{App: host, Port: info.port}
+		return &route.RouteAction{
+			ClusterSpecifier: &route.RouteAction_Cluster{
+				Cluster: clusterInfo.Name(),
+			},
+		}
+	}
+
+	var clusters []*route.WeightedCluster_ClusterWeight
+	for _, backend := range backends {
+		clusterInfo := OutboundClusterInfo{App: host, Port: info.port, Subset: backend.Version}
+		clusters = append(clusters, &route.WeightedCluster_ClusterWeight{
+			Name:   clusterInfo.Name(),
+			Weight: &types.UInt32Value{Value: backend.Weight},
+		})
+	}
+	return &route.RouteAction{
+		ClusterSpecifier: &route.RouteAction_WeightedClusters{
+			WeightedClusters: &route.WeightedCluster{
+				Clusters:    clusters,
+				TotalWeight: &types.UInt32Value{Value: kubernetes.TRAFFIC_SPLIT_TOTAL},
+			},
+		},
+	}
 }
 
 type RoutesDiscoveryService struct {
 	DiscoveryService
-	k8sManager *kubernetes.K8sResourceManager
+	externalPorts map[uint32]bool
+	//serialize read-modify-write of RouteInfo between watchers
+	updateMutex sync.Mutex
 }
 
-func NewRoutesDiscoveryService(k8sManager *kubernetes.K8sResourceManager) *RoutesDiscoveryService {
+func NewRoutesDiscoveryService() *RoutesDiscoveryService {
 	result := &RoutesDiscoveryService{
 		DiscoveryService: NewDiscoveryService(),
-		k8sManager:       k8sManager,
+		externalPorts:    make(map[uint32]bool),
 	}
 	portMap := make(map[uint32]*RouteInfo)
-	for service, port := range kubernetes.DemoAppSet {
+	for service, port := range kubernetes.GetMeshConfig().Apps {
 		routeInfo := portMap[port]
 		if routeInfo == nil {
 			routeInfo = &RouteInfo{
@@ -52,6 +109,110 @@ func NewRoutesDiscoveryService(k8sManager *kubernetes.K8sResourceManager) *Route
 	return result
 }
 
+func (rds *RoutesDiscoveryService) ServiceEntriesChanged(entries []*kubernetes.ServiceEntryInfo) {
+	rds.updateMutex.Lock()
+	defer rds.updateMutex.Unlock()
+
+	externalHosts := NewExternalRouteHosts(entries)
+	versions := make(map[uint32][]string)
+	for _, entry := range entries {
+		for _, port := range entry.Ports {
+			if port.IsHTTP() {
+				versions[port.Number] = append(versions[port.Number], entry.ResourceVersion)
+			}
+		}
+	}
+
+	ports := make(map[uint32]bool)
+	for port := range rds.externalPorts {
+		ports[port] = true
+	}
+	for port := range externalHosts {
+		ports[port] = true
+	}
+	for port := range ports {
+		routeInfo := &RouteInfo{port: port}
+		resource := rds.GetResource(routeInfo.Name())
+		if resource != nil {
+			routeInfo = resource.(*RouteInfo).clone()
+		}
+		routeInfo.externalVersion = ""
+		routeInfo.externalHosts = externalHosts[port]
+		if len(routeInfo.externalHosts) > 0 {
+			sort.Strings(versions[port])
+			routeInfo.externalVersion = strings.Join(versions[port], "-")
+		}
+		rds.UpdateResource(routeInfo)
+	}
+
+	rds.externalPorts = make(map[uint32]bool)
+	for port := range externalHosts {
+		rds.externalPorts[port] = true
+	}
+}
+
+func (rds *RoutesDiscoveryService) TrafficSplitsChanged(splits []*kubernetes.TrafficSplitInfo) {
+	rds.updateMutex.Lock()
+	defer rds.updateMutex.Unlock()
+
+	portSplits := make(map[uint32]map[string][]kubernetes.TrafficSplitBackend)
+	portVersions := make(map[uint32][]string)
+	for _, split := range splits {
+		port := kubernetes.AppPort(split.Service)
+		if portSplits[port] == nil {
+			portSplits[port] = make(map[string][]kubernetes.TrafficSplitBackend)
+		}
+		portSplits[port][split.Service] = split.Backends
+		portVersions[port] = append(portVersions[port], split.ResourceVersion)
+	}
+
+	ports := make(map[uint32]bool)
+	for _, port := range kubernetes.GetMeshConfig().Apps {
+		ports[port] = true
+	}
+	for port := range ports {
+		routeInfo := &RouteInfo{port: port}
+		resource := rds.GetResource(routeInfo.Name())
+		if resource == nil {
+			continue
+		}
+		routeInfo = resource.(*RouteInfo).clone()
+		routeInfo.splits = portSplits[port]
+		sort.Strings(portVersions[port])
+		routeInfo.splitVersion = strings.Join(portVersions[port], "-")
+		rds.UpdateResource(routeInfo)
+	}
+}
+
+func (rds *RoutesDiscoveryService) ServiceClusterIPsChanged(clusterIPs map[string]string) {
+	rds.updateMutex.Lock()
+	defer rds.updateMutex.Unlock()
+
+	ports := make(map[uint32]bool)
+	for _, port := range kubernetes.GetMeshConfig().Apps {
+		ports[port] = true
+	}
+	for port := range ports {
+		routeInfo := &RouteInfo{port: port}
+		resource := rds.GetResource(routeInfo.Name())
+		if resource == nil {
+			continue
+		}
+		routeInfo = resource.(*RouteInfo).clone()
+		routeInfo.clusterIPs = make(map[string]string)
+		var versions []string
+		for _, host := range routeInfo.hosts {
+			if ip := clusterIPs[host]; ip != "" {
+				routeInfo.clusterIPs[host] = ip
+				versions = append(versions, ip)
+			}
+		}
+		sort.Strings(versions)
+		routeInfo.clusterIPVersion = strings.Join(versions, "-")
+		rds.UpdateResource(routeInfo)
+	}
+}
+
 func (rds *RoutesDiscoveryService) StreamRoutes(stream v2.RouteDiscoveryService_StreamRoutesServer) error {
 	return rds.ProcessStream(stream, rds.BuildResource)
 }
@@ -62,6 +223,7 @@ func (rds *RoutesDiscoveryService) FetchRoutes(ctx context.Context, req *v2.Disc
 
 func (rds *RoutesDiscoveryService) BuildResource(resourceMap map[string]EnvoyResource, version string, node *core.Node) (*v2.DiscoveryResponse, error) {
 
+	namespace := kubernetes.GetMeshConfig().AppNamespace
 	var routes []proto.Message
 	for port, resource := range resourceMap {
 		routeInfo := resource.(*RouteInfo)
@@ -70,15 +232,32 @@ func (rds *RoutesDiscoveryService) BuildResource(resourceMap map[string]EnvoyRes
 		for _, host := range routeInfo.hosts {
 			var domains []string
 			domains = append(domains, fmt.Sprintf("%s:%s", host, port))
-			domains = append(domains, fmt.Sprintf("%s.%s:%s", host, kubernetes.APP_NAMESPACE, port))
-			clusterIp, err := rds.k8sManager.GetServiceClusterIP(host, kubernetes.APP_NAMESPACE)
-			if err == nil && clusterIp != "" {
+			domains = append(domains, fmt.Sprintf("%s.%s:%s", host, namespace, port))
+			if clusterIp := routeInfo.clusterIPs[host]; clusterIp != "" {
 				domains = append(domains, fmt.Sprintf("%s:%s", clusterIp, port))
 			}
-			clusterInfo := OutboundClusterInfo{App: host, Port: routeInfo.port}
 			virtualHost := route.VirtualHost{
 				Name:    fmt.Sprintf("%s_%s_vh", host, port),
 				Domains: domains,
+				Routes: []route.Route{{
+					Match: route.RouteMatch{
+						PathSpecifier: &route.RouteMatch_Prefix{
+							Prefix: "/",
+						},
+					},
+					Action: &route.Route_Route{
+						Route: routeInfo.createRouteAction(host),
+					},
+					Tracing: CreateRouteTracing(host),
+				}},
+			}
+			virtualHostList = append(virtualHostList, virtualHost)
+		}
+		for _, host := range routeInfo.externalHosts {
+			clusterInfo := OutboundClusterInfo{App: host, Port: routeInfo.port}
+			virtualHostList = append(virtualHostList, route.VirtualHost{
+				Name:    fmt.Sprintf("%s_%s_vh", host, port),
+				Domains: []string{host, fmt.Sprintf("%s:%s", host, port)},
 				Routes: []route.Route{{
 					Match: route.RouteMatch{
 						PathSpecifier: &route.RouteMatch_Prefix{
@@ -92,9 +271,29 @@ func (rds *RoutesDiscoveryService) BuildResource(resourceMap map[string]EnvoyRes
 							},
 						},
 					},
+					Tracing: CreateRouteTracing(host),
 				}},
-			}
-			virtualHostList = append(virtualHostList, virtualHost)
+			})
+		}
+		if kubernetes.GetMeshConfig().OutboundTrafficPolicy == kubernetes.OUTBOUND_ALLOW_ANY {
+			virtualHostList = append(virtualHostList, route.VirtualHost{
+				Name:    "allow_any",
+				Domains: []string{"*"},
+				Routes: []route.Route{{
+					Match: route.RouteMatch{
+						PathSpecifier: &route.RouteMatch_Prefix{
+							Prefix: "/",
+						},
+					},
+					Action: &route.Route_Route{
+						Route: &route.RouteAction{
+							ClusterSpecifier: &route.RouteAction_Cluster{
+								Cluster: PassthroughCluster,
+							},
+						},
+					},
+				}},
+			})
 		}
 
 		routes = append(routes, &v2.RouteConfiguration{
@@ -103,5 +302,5 @@ func (rds *RoutesDiscoveryService) BuildResource(resourceMap map[string]EnvoyRes
 		})
 	}
 
-	return MakeResource(routes, RouteResource, version)
+	return rds.BuildResponse(routes, RouteResource, version)
 }
@@ -0,0 +1,55 @@
+package envoy
+
+import (
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/route"
+	hcm "github.com/envoyproxy/go-control-plane/envoy/config/filter/network/http_connection_manager/v2"
+	envoy_type "github.com/envoyproxy/go-control-plane/envoy/type"
+	"github.com/luguoxiang/envoy-demo/pkg/kubernetes"
+)
+
+func toPercent(value *float64) *envoy_type.Percent {
+	if value == nil {
+		return nil
+	}
+	return &envoy_type.Percent{Value: *value}
+}
+
+func toFractionalPercent(value *float64) *envoy_type.FractionalPercent {
+	if value == nil {
+		return nil
+	}
+	return &envoy_type.FractionalPercent{
+		Numerator:   uint32(*value*100 + 0.5),
+		Denominator: envoy_type.FractionalPercent_TEN_THOUSAND,
+	}
+}
+
+// CreateTracing returns the tracing of http connection managers, service is empty for outbound traffic.
+func CreateTracing(operation hcm.HttpConnectionManager_Tracing_OperationName, service string) *hcm.HttpConnectionManager_Tracing {
+	config := kubernetes.GetMeshConfig().Tracing
+	if !config.Enabled() {
+		return nil
+	}
+	sampling := config.ServiceSampling(service)
+	return &hcm.HttpConnectionManager_Tracing{
+		OperationName:         operation,
+		RequestHeadersForTags: config.CustomTags,
+		ClientSampling:        toPercent(sampling.Client),
+		RandomSampling:        toPercent(sampling.Random),
+		OverallSampling:       toPercent(sampling.Overall),
+	}
+}
+
+// CreateRouteTracing returns the tracing overrides of routes to host, or nil if there are none.
+func CreateRouteTracing(host string) *route.Tracing {
+	config := kubernetes.GetMeshConfig().Tracing
+	sampling, ok := config.Routes[host]
+	if !config.Enabled() || !ok {
+		return nil
+	}
+	return &route.Tracing{
+		ClientSampling:  toFractionalPercent(sampling.Client),
+		RandomSampling:  toFractionalPercent(sampling.Random),
+		OverallSampling: toFractionalPercent(sampling.Overall),
+	}
+}
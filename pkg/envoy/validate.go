@@ -0,0 +1,176 @@
+package envoy
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/gogo/protobuf/proto"
+)
+
+// ResourceLookup tells whether a resource exists, it is used to check references between resource types.
+type ResourceLookup interface {
+	HasResource(typeURL string, name string) bool
+}
+
+type validator interface {
+	Validate() error
+}
+
+// ValidationResult holds the errors which make resources invalid and the warnings about
+// resources envoy accepts but which will not work as intended.
+type ValidationResult struct {
+	Errors   []string
+	Warnings []string
+	//indexes of the resources with errors, of duplicates all but the first one
+	Invalid map[int]bool
+}
+
+func (result *ValidationResult) addError(index int, format string, args ...interface{}) {
+	result.Errors = append(result.Errors, fmt.Sprintf(format, args...))
+	result.Invalid[index] = true
+}
+
+func (result *ValidationResult) addWarning(format string, args ...interface{}) {
+	result.Warnings = append(result.Warnings, fmt.Sprintf(format, args...))
+}
+
+type ValidationError struct {
+	TypeURL string
+	Errors  []string
+}
+
+func (err *ValidationError) Error() string {
+	return fmt.Sprintf("invalid %s: %s", err.TypeURL, strings.Join(err.Errors, "; "))
+}
+
+func resourceName(resource proto.Message) string {
+	switch r := resource.(type) {
+	case *v2.Listener:
+		return r.Name
+	case *v2.Cluster:
+		return r.Name
+	case *v2.RouteConfiguration:
+		return r.Name
+	case *v2.ClusterLoadAssignment:
+		return r.ClusterName
+	}
+	return ""
+}
+
+func listenerAddress(l *v2.Listener) string {
+	if socket := l.Address.GetSocketAddress(); socket != nil {
+		return fmt.Sprintf("%s:%d", socket.Address, socket.GetPortValue())
+	}
+	return proto.CompactTextString(&l.Address)
+}
+
+// EndpointResourceName returns the name of the ClusterLoadAssignment of an EDS cluster.
+func EndpointResourceName(cluster *v2.Cluster) string {
+	if cluster.EdsClusterConfig != nil && cluster.EdsClusterConfig.ServiceName != "" {
+		return cluster.EdsClusterConfig.ServiceName
+	}
+	return cluster.Name
+}
+
+// RouteClusters returns the names of the clusters the routes of config send requests to.
+func RouteClusters(config *v2.RouteConfiguration) []string {
+	var result []string
+	seen := make(map[string]bool)
+	add := func(cluster string) {
+		if !seen[cluster] {
+			seen[cluster] = true
+			result = append(result, cluster)
+		}
+	}
+	for _, host := range config.VirtualHosts {
+		for _, r := range host.Routes {
+			action := r.GetRoute()
+			if action == nil {
+				continue
+			}
+			if cluster := action.GetCluster(); cluster != "" {
+				add(cluster)
+			}
+			if weighted := action.GetWeightedClusters(); weighted != nil {
+				for _, cluster := range weighted.Clusters {
+					add(cluster.Name)
+				}
+			}
+		}
+	}
+	return result
+}
+
+// ValidResources returns the resources without errors sorted by name, so that errors are reported
+// the same way on every build. resources is left unchanged.
+func ValidResources(typeURL string, resources []proto.Message, lookup ResourceLookup) ([]proto.Message, *ValidationResult) {
+	sorted := append([]proto.Message(nil), resources...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return resourceName(sorted[i]) < resourceName(sorted[j])
+	})
+	result := ValidateResources(typeURL, sorted, lookup)
+	var valid []proto.Message
+	for index, resource := range sorted {
+		if !result.Invalid[index] {
+			valid = append(valid, resource)
+		}
+	}
+	return valid, result
+}
+
+// ValidateResources runs the generated Validate of resources of typeURL and checks them against each other.
+// References to resources of other types are checked only if lookup is not nil.
+// Invalid resources are not checked any further, so that they do not shadow valid ones.
+func ValidateResources(typeURL string, resources []proto.Message, lookup ResourceLookup) *ValidationResult {
+	result := &ValidationResult{Invalid: make(map[int]bool)}
+	names := make(map[string]bool)
+	addresses := make(map[string]string)
+	for index, resource := range resources {
+		name := resourceName(resource)
+		if v, ok := resource.(validator); ok {
+			if err := v.Validate(); err != nil {
+				result.addError(index, "%s: %s", name, err.Error())
+				continue
+			}
+		}
+		if names[name] {
+			result.addError(index, "%s: duplicate name", name)
+			continue
+		}
+		names[name] = true
+
+		switch r := resource.(type) {
+		case *v2.Listener:
+			address := listenerAddress(r)
+			if other, ok := addresses[address]; ok {
+				result.addError(index, "%s: address %s is also used by %s", name, address, other)
+				continue
+			}
+			addresses[address] = name
+		case *v2.Cluster:
+			if lookup != nil && r.GetType() == v2.Cluster_EDS && !lookup.HasResource(EndpointResource, EndpointResourceName(r)) {
+				result.addWarning("%s: EDS cluster has no endpoint assignment %s", name, EndpointResourceName(r))
+			}
+		case *v2.RouteConfiguration:
+			if lookup == nil {
+				continue
+			}
+			for _, cluster := range RouteClusters(r) {
+				if !lookup.HasResource(ClusterResource, cluster) {
+					result.addWarning("%s: routes to missing cluster %s", name, cluster)
+				}
+			}
+		case *v2.ClusterLoadAssignment:
+			count := 0
+			for _, locality := range r.Endpoints {
+				count += len(locality.LbEndpoints)
+			}
+			if count == 0 {
+				result.addWarning("%s: no endpoints, requests fail with 503", name)
+			}
+		}
+	}
+	return result
+}
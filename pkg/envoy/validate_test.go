@@ -0,0 +1,116 @@
+package envoy
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	"github.com/gogo/protobuf/proto"
+)
+
+func testListener(name string, address string, port uint32) *v2.Listener {
+	return &v2.Listener{
+		Name: name,
+		Address: core.Address{
+			Address: &core.Address_SocketAddress{
+				SocketAddress: &core.SocketAddress{
+					Protocol: core.TCP,
+					Address:  address,
+					PortSpecifier: &core.SocketAddress_PortValue{
+						PortValue: port,
+					},
+				},
+			},
+		},
+	}
+}
+
+func TestValidateResources(t *testing.T) {
+	cases := []struct {
+		name      string
+		typeURL   string
+		resources []proto.Message
+		invalid   map[int]bool
+	}{
+		{
+			name:    "distinct listeners",
+			typeURL: ListenerResource,
+			resources: []proto.Message{
+				testListener("a", "0.0.0.0", 80),
+				testListener("b", "0.0.0.0", 81),
+			},
+			invalid: map[int]bool{},
+		},
+		{
+			name:    "duplicate name",
+			typeURL: ListenerResource,
+			resources: []proto.Message{
+				testListener("a", "0.0.0.0", 80),
+				testListener("a", "0.0.0.0", 81),
+			},
+			invalid: map[int]bool{1: true},
+		},
+		{
+			name:    "duplicate address",
+			typeURL: ListenerResource,
+			resources: []proto.Message{
+				testListener("a", "0.0.0.0", 80),
+				testListener("b", "0.0.0.0", 80),
+				testListener("c", "127.0.0.1", 80),
+			},
+			invalid: map[int]bool{1: true},
+		},
+		{
+			name:    "invalid resource does not shadow a valid one",
+			typeURL: ListenerResource,
+			resources: []proto.Message{
+				testListener("a", "", 80),
+				testListener("a", "0.0.0.0", 80),
+			},
+			invalid: map[int]bool{0: true},
+		},
+		{
+			name:    "duplicate assignment",
+			typeURL: EndpointResource,
+			resources: []proto.Message{
+				&v2.ClusterLoadAssignment{ClusterName: "outbound|reviews:9080"},
+				&v2.ClusterLoadAssignment{ClusterName: "outbound|reviews:9080"},
+				&v2.ClusterLoadAssignment{ClusterName: "outbound|ratings:9080"},
+			},
+			invalid: map[int]bool{1: true},
+		},
+	}
+	for _, c := range cases {
+		result := ValidateResources(c.typeURL, c.resources, nil)
+		if !reflect.DeepEqual(result.Invalid, c.invalid) {
+			t.Errorf("%s: expect invalid %v, got %v, errors %v", c.name, c.invalid, result.Invalid, result.Errors)
+		}
+		if len(result.Errors) != len(c.invalid) {
+			t.Errorf("%s: expect %d errors, got %v", c.name, len(c.invalid), result.Errors)
+		}
+	}
+}
+
+func TestValidResourcesFirstByName(t *testing.T) {
+	resources := []proto.Message{
+		testListener("b", "0.0.0.0", 81),
+		testListener("a", "0.0.0.0", 80),
+		testListener("a", "0.0.0.0", 82),
+	}
+	valid, result := ValidResources(ListenerResource, resources, nil)
+	if len(result.Errors) != 1 {
+		t.Errorf("expect 1 error, got %v", result.Errors)
+	}
+	var addresses []string
+	for _, resource := range valid {
+		addresses = append(addresses, listenerAddress(resource.(*v2.Listener)))
+	}
+	expected := []string{"0.0.0.0:80", "0.0.0.0:81"}
+	if !reflect.DeepEqual(addresses, expected) {
+		t.Errorf("expect %v, got %v", expected, addresses)
+	}
+	if name := resources[0].(*v2.Listener).Name; name != "b" {
+		t.Errorf("resources of the caller were reordered, first one is %s", name)
+	}
+}
@@ -0,0 +1,527 @@
+package kubernetes
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/golang/glog"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	CANARY_PLURAL = "canaries"
+	CANARY_KIND   = "Canary"
+
+	CANARY_PHASE_PROGRESSING = "Progressing"
+	CANARY_PHASE_SUCCEEDED   = "Succeeded"
+	CANARY_PHASE_ROLLED_BACK = "RolledBack"
+
+	DEFAULT_CANARY_STEP_INTERVAL = time.Minute
+	//a step which cannot be judged, e.g. without canary pods or requests, is rolled back after
+	//stepTimeout, by default this many step intervals
+	DEFAULT_CANARY_STEP_TIMEOUT_INTERVALS = 5
+	//consecutive checks with unreachable canary pods before rolling back
+	CANARY_MAX_SCRAPE_FAILURES = 3
+
+	//only one control plane replica drives the rollouts
+	CANARY_LEADER_LOCK    = "envoy-demo-canary-leader"
+	CANARY_LEASE_DURATION = 15 * time.Second
+	CANARY_RENEW_DEADLINE = 10 * time.Second
+	CANARY_RETRY_PERIOD   = 2 * time.Second
+
+	//quantile of the request latency compared with maxLatencyMs
+	CANARY_LATENCY_QUANTILE = 0.99
+)
+
+type CanaryThresholds struct {
+	//percentage of non 5xx responses, e.g. 99.5
+	MinSuccessRate float64 `json:"minSuccessRate,omitempty"`
+	//p99 latency of canary pods in milliseconds
+	MaxLatencyMs float64 `json:"maxLatencyMs,omitempty"`
+	//requests required before a step can be judged
+	MinRequests uint64 `json:"minRequests,omitempty"`
+}
+
+type CanarySpec struct {
+	App           string           `json:"app"`
+	StableVersion string           `json:"stableVersion"`
+	CanaryVersion string           `json:"canaryVersion"`
+	Steps         []uint32         `json:"steps"`
+	StepInterval  string           `json:"stepInterval,omitempty"`
+	StepTimeout   string           `json:"stepTimeout,omitempty"`
+	Thresholds    CanaryThresholds `json:"thresholds,omitempty"`
+}
+
+type CanaryStatus struct {
+	Phase         string `json:"phase,omitempty"`
+	CanaryVersion string `json:"canaryVersion,omitempty"`
+	CurrentStep   int    `json:"currentStep"`
+	CanaryWeight  uint32 `json:"canaryWeight"`
+	StepStartTime string `json:"stepStartTime,omitempty"`
+	RequestCount  uint64 `json:"requestCount"`
+	ErrorCount    uint64 `json:"errorCount"`
+	//container restarts of the canary pods when the step started
+	RestartCount int32 `json:"restartCount"`
+	//cumulative request latency histogram of the canary pods when the step started, by upper bound in ms
+	LatencyBuckets map[string]uint64 `json:"latencyBuckets,omitempty"`
+	ScrapeFailures int               `json:"scrapeFailures,omitempty"`
+	Message        string            `json:"message,omitempty"`
+}
+
+type Canary struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              CanarySpec   `json:"spec"`
+	Status            CanaryStatus `json:"status,omitempty"`
+}
+
+type CanaryList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []Canary `json:"items"`
+}
+
+func (canary *Canary) String() string {
+	return fmt.Sprintf("Canary %s@%s app %s %s->%s",
+		canary.Name, canary.Namespace, canary.Spec.App, canary.Spec.StableVersion, canary.Spec.CanaryVersion)
+}
+
+func (canary *Canary) stepInterval() time.Duration {
+	if canary.Spec.StepInterval != "" {
+		interval, err := time.ParseDuration(canary.Spec.StepInterval)
+		if err == nil {
+			return interval
+		}
+		glog.Warningf("%s has invalid stepInterval %s", canary.String(), canary.Spec.StepInterval)
+	}
+	return DEFAULT_CANARY_STEP_INTERVAL
+}
+
+func (canary *Canary) stepTimeout() time.Duration {
+	if canary.Spec.StepTimeout != "" {
+		timeout, err := time.ParseDuration(canary.Spec.StepTimeout)
+		if err == nil {
+			return timeout
+		}
+		glog.Warningf("%s has invalid stepTimeout %s", canary.String(), canary.Spec.StepTimeout)
+	}
+	return DEFAULT_CANARY_STEP_TIMEOUT_INTERVALS * canary.stepInterval()
+}
+
+func (canary *Canary) selector(version string) string {
+	return fmt.Sprintf("%s=%s,%s=%s", APP_LABEL, canary.Spec.App, VERSION_LABEL, version)
+}
+
+type canaryMetrics struct {
+	Requests uint64
+	Errors   uint64
+	//cumulative request latency histogram, by upper bound in ms
+	LatencyBuckets map[string]uint64
+	//canary pods with an ip, and those whose stats could not be read
+	Pods        int
+	Unreachable int
+	Restarts    int32
+}
+
+// CanaryController shifts traffic from the stable version of an app to the canary version
+// step by step through endpoint weight annotations, and rolls back when the canary pods
+// violate the configured thresholds.
+type CanaryController struct {
+	k8sManager *K8sResourceManager
+	httpClient *http.Client
+}
+
+func NewCanaryController(k8sManager *K8sResourceManager) *CanaryController {
+	return &CanaryController{
+		k8sManager: k8sManager,
+		httpClient: &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+// Run reconciles canaries while this replica holds the leader lock, so that replicas do not
+// race on step advancement and weight annotations.
+func (controller *CanaryController) Run(stopper chan struct{}) {
+	id, err := os.Hostname()
+	if err != nil {
+		glog.Errorf("failed to get hostname, canaries are not reconciled: %s", err.Error())
+		return
+	}
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock: &resourcelock.ConfigMapLock{
+			ConfigMapMeta: metav1.ObjectMeta{
+				Namespace: ControlPlaneNamespace(),
+				Name:      CANARY_LEADER_LOCK,
+			},
+			Client: controller.k8sManager.clientSet.CoreV1(),
+			LockConfig: resourcelock.ResourceLockConfig{
+				Identity: id,
+			},
+		},
+		LeaseDuration: CANARY_LEASE_DURATION,
+		RenewDeadline: CANARY_RENEW_DEADLINE,
+		RetryPeriod:   CANARY_RETRY_PERIOD,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: func(stop <-chan struct{}) {
+				glog.Infof("%s leads canary rollouts", id)
+				wait.Until(controller.reconcileAll, CRD_POLL_INTERVAL, stop)
+			},
+			OnStoppedLeading: func() {
+				glog.Infof("%s stopped leading canary rollouts", id)
+			},
+		},
+	})
+	if err != nil {
+		glog.Errorf("failed to create canary leader election: %s", err.Error())
+		return
+	}
+	//Run returns when the lease is lost, then try to acquire it again
+	wait.Until(elector.Run, CANARY_RETRY_PERIOD, stopper)
+}
+
+func (controller *CanaryController) reconcileAll() {
+	var list CanaryList
+	if err := controller.k8sManager.ListCustomResources(CANARY_PLURAL, &list); err != nil {
+		glog.Errorf("failed to list canaries: %s", err.Error())
+		return
+	}
+	for i := range list.Items {
+		canary := &list.Items[i]
+		if err := controller.reconcile(canary); err != nil {
+			glog.Errorf("failed to reconcile %s: %s", canary.String(), err.Error())
+		}
+	}
+}
+
+func (controller *CanaryController) reconcile(canary *Canary) error {
+	if err := canary.Validate(); err != nil {
+		return err
+	}
+	status := canary.Status
+	if status.CanaryVersion != canary.Spec.CanaryVersion {
+		glog.Infof("Start rollout of %s", canary.String())
+		status = CanaryStatus{
+			Phase:         CANARY_PHASE_PROGRESSING,
+			CanaryVersion: canary.Spec.CanaryVersion,
+		}
+		return controller.startStep(canary, status)
+	}
+	if status.Phase != CANARY_PHASE_PROGRESSING {
+		return nil
+	}
+
+	start, err := time.Parse(time.RFC3339, status.StepStartTime)
+	if err == nil && time.Since(start) < canary.stepInterval() {
+		return nil
+	}
+
+	timedOut := err == nil && time.Since(start) > canary.stepTimeout()
+
+	metrics, err := controller.collectMetrics(canary)
+	if err != nil {
+		return err
+	}
+	//a crash looping canary would otherwise stall the rollout without ever serving requests
+	if metrics.Restarts > status.RestartCount {
+		return controller.rollback(canary, status,
+			fmt.Sprintf("canary pods restarted %d times", metrics.Restarts-status.RestartCount))
+	}
+	if metrics.Unreachable > 0 {
+		status.ScrapeFailures++
+		if status.ScrapeFailures >= CANARY_MAX_SCRAPE_FAILURES {
+			return controller.rollback(canary, status,
+				fmt.Sprintf("stats of %d of %d canary pods are unreachable", metrics.Unreachable, metrics.Pods))
+		}
+		glog.Warningf("%s: stats of %d of %d canary pods are unreachable", canary.String(), metrics.Unreachable, metrics.Pods)
+		return controller.updateStatus(canary, status)
+	}
+	scrapeFailures := status.ScrapeFailures
+	status.ScrapeFailures = 0
+
+	//counters are reset when canary pods restart
+	if metrics.Requests < status.RequestCount || metrics.Errors < status.ErrorCount {
+		status.RequestCount = 0
+		status.ErrorCount = 0
+	}
+	requests := metrics.Requests - status.RequestCount
+	errors := metrics.Errors - status.ErrorCount
+	if metrics.Pods == 0 || requests == 0 || requests < canary.Spec.Thresholds.MinRequests {
+		if timedOut {
+			return controller.rollback(canary, status,
+				fmt.Sprintf("step timed out after %s with %d requests to %d canary pods", canary.stepTimeout(), requests, metrics.Pods))
+		}
+		glog.Infof("%s step %d has only %d requests to %d canary pods, waiting", canary.String(), status.CurrentStep, requests, metrics.Pods)
+		if scrapeFailures > 0 {
+			return controller.updateStatus(canary, status)
+		}
+		return nil
+	}
+
+	thresholds := canary.Spec.Thresholds
+	successRate := float64(requests-errors) * 100 / float64(requests)
+	if thresholds.MinSuccessRate > 0 && successRate < thresholds.MinSuccessRate {
+		return controller.rollback(canary, status,
+			fmt.Sprintf("success rate %.2f%% is below %.2f%%", successRate, thresholds.MinSuccessRate))
+	}
+	if thresholds.MaxLatencyMs > 0 {
+		//only the requests of this step are judged, not those of earlier steps and warm up
+		latency, ok := latencyQuantile(metrics.LatencyBuckets, status.LatencyBuckets, CANARY_LATENCY_QUANTILE)
+		if ok && latency > thresholds.MaxLatencyMs {
+			return controller.rollback(canary, status,
+				fmt.Sprintf("p99 latency %.2fms is above %.2fms", latency, thresholds.MaxLatencyMs))
+		}
+	}
+
+	status.CurrentStep++
+	if status.CurrentStep >= len(canary.Spec.Steps) {
+		return controller.promote(canary, status)
+	}
+	return controller.startStep(canary, status)
+}
+
+func (controller *CanaryController) startStep(canary *Canary, status CanaryStatus) error {
+	weight := canary.Spec.Steps[status.CurrentStep]
+	if weight > 100 {
+		weight = 100
+	}
+	if err := controller.setWeights(canary, weight); err != nil {
+		return err
+	}
+	metrics, err := controller.collectMetrics(canary)
+	if err != nil {
+		return err
+	}
+	status.CanaryWeight = weight
+	status.StepStartTime = time.Now().UTC().Format(time.RFC3339)
+	status.RequestCount = metrics.Requests
+	status.ErrorCount = metrics.Errors
+	status.RestartCount = metrics.Restarts
+	status.LatencyBuckets = metrics.LatencyBuckets
+	status.ScrapeFailures = 0
+	status.Message = fmt.Sprintf("step %d/%d: %d%% traffic to %s",
+		status.CurrentStep+1, len(canary.Spec.Steps), weight, canary.Spec.CanaryVersion)
+	glog.Infof("%s %s", canary.String(), status.Message)
+	return controller.updateStatus(canary, status)
+}
+
+func (controller *CanaryController) promote(canary *Canary, status CanaryStatus) error {
+	if err := controller.setWeights(canary, 100); err != nil {
+		return err
+	}
+	status.Phase = CANARY_PHASE_SUCCEEDED
+	status.CanaryWeight = 100
+	status.Message = fmt.Sprintf("%s promoted", canary.Spec.CanaryVersion)
+	glog.Infof("%s %s", canary.String(), status.Message)
+	return controller.updateStatus(canary, status)
+}
+
+func (controller *CanaryController) rollback(canary *Canary, status CanaryStatus, reason string) error {
+	if err := controller.setWeights(canary, 0); err != nil {
+		return err
+	}
+	status.Phase = CANARY_PHASE_ROLLED_BACK
+	status.CanaryWeight = 0
+	status.Message = fmt.Sprintf("rolled back at step %d: %s", status.CurrentStep+1, reason)
+	glog.Warningf("%s %s", canary.String(), status.Message)
+	return controller.updateStatus(canary, status)
+}
+
+func (controller *CanaryController) updateStatus(canary *Canary, status CanaryStatus) error {
+	return controller.k8sManager.PatchCustomResource(CANARY_PLURAL, canary.Namespace, canary.Name,
+		map[string]interface{}{"status": status})
+}
+
+// canaryWeights returns the per pod weights giving the canary pods canaryPercent of the
+// traffic in total, whatever the number of stable and canary pods is.
+func canaryWeights(canaryPercent uint32, stablePods int, canaryPods int) (uint32, uint32) {
+	var stableShare, canaryShare float64
+	if stablePods > 0 {
+		stableShare = float64(100-canaryPercent) / float64(stablePods)
+	}
+	if canaryPods > 0 {
+		canaryShare = float64(canaryPercent) / float64(canaryPods)
+	}
+	max := math.Max(stableShare, canaryShare)
+	scale := func(share float64) uint32 {
+		if share == 0 {
+			return 0
+		}
+		result := uint32(math.Floor(share/max*DEFAULT_WEIGHT + 0.5))
+		if result == 0 {
+			return 1
+		}
+		return result
+	}
+	return scale(stableShare), scale(canaryShare)
+}
+
+func (controller *CanaryController) setWeights(canary *Canary, canaryPercent uint32) error {
+	stablePods, err := controller.k8sManager.ListPods(canary.Namespace, canary.selector(canary.Spec.StableVersion))
+	if err != nil {
+		return err
+	}
+	canaryPods, err := controller.k8sManager.ListPods(canary.Namespace, canary.selector(canary.Spec.CanaryVersion))
+	if err != nil {
+		return err
+	}
+	stableWeight, canaryWeight := canaryWeights(canaryPercent, len(stablePods), len(canaryPods))
+	for _, pods := range []struct {
+		pods   []*PodInfo
+		weight uint32
+	}{{stablePods, stableWeight}, {canaryPods, canaryWeight}} {
+		for _, pod := range pods.pods {
+			if pod.Annotations[ENDPOINT_WEIGHT_ANNOTATION] == fmt.Sprint(pods.weight) {
+				continue
+			}
+			annotations := map[string]string{ENDPOINT_WEIGHT_ANNOTATION: fmt.Sprint(pods.weight)}
+			if err := controller.k8sManager.SetPodAnnotation(annotations, pod); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (controller *CanaryController) collectMetrics(canary *Canary) (*canaryMetrics, error) {
+	pods, err := controller.k8sManager.ListPods(canary.Namespace, canary.selector(canary.Spec.CanaryVersion))
+	if err != nil {
+		return nil, err
+	}
+	result := &canaryMetrics{LatencyBuckets: make(map[string]uint64)}
+	for _, pod := range pods {
+		result.Restarts += pod.Restarts
+		if pod.PodIP == "" {
+			continue
+		}
+		result.Pods++
+		err := controller.collectPodMetrics(pod, result)
+		if err == nil {
+			err = controller.collectPodLatency(pod, result)
+		}
+		if err != nil {
+			glog.Warningf("failed to collect metrics of %s: %s", pod.String(), err.Error())
+			result.Unreachable++
+		}
+	}
+	return result, nil
+}
+
+// collectPodMetrics reads the inbound http connection manager stats from the envoy admin port of the pod.
+func (controller *CanaryController) collectPodMetrics(pod *PodInfo, result *canaryMetrics) error {
+	resp, err := controller.httpClient.Get(fmt.Sprintf("http://%s:%d/stats", pod.PodIP, GetMeshConfig().Proxy.ManagePort))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returns status %d for stats", pod.String(), resp.StatusCode)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "http.inbound|") {
+			continue
+		}
+		index := strings.LastIndex(line, ": ")
+		if index < 0 {
+			continue
+		}
+		name, value := line[:index], line[index+2:]
+		switch {
+		case strings.HasSuffix(name, ".downstream_rq_5xx"):
+			count, _ := strconv.ParseUint(value, 10, 64)
+			result.Requests += count
+			result.Errors += count
+		case strings.HasSuffix(name, ".downstream_rq_2xx"),
+			strings.HasSuffix(name, ".downstream_rq_3xx"),
+			strings.HasSuffix(name, ".downstream_rq_4xx"):
+			count, _ := strconv.ParseUint(value, 10, 64)
+			result.Requests += count
+		}
+	}
+	return scanner.Err()
+}
+
+// collectPodLatency adds the inbound request latency histogram of the pod to result. Unlike the
+// quantiles of /stats, the buckets of /stats/prometheus are counters, so the histogram of a step
+// is the difference to the one of its start.
+func (controller *CanaryController) collectPodLatency(pod *PodInfo, result *canaryMetrics) error {
+	resp, err := controller.httpClient.Get(fmt.Sprintf("http://%s:%d/stats/prometheus", pod.PodIP, GetMeshConfig().Proxy.ManagePort))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returns status %d for prometheus stats", pod.String(), resp.StatusCode)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		//envoy_http_downstream_rq_time_bucket{envoy_http_conn_manager_prefix="inbound|9080",le="0.5"} 3
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "envoy_http_downstream_rq_time_bucket{") ||
+			!strings.Contains(line, `envoy_http_conn_manager_prefix="inbound|`) {
+			continue
+		}
+		start := strings.Index(line, `le="`)
+		end := strings.LastIndex(line, "} ")
+		if start < 0 || end < start {
+			continue
+		}
+		bound := line[start+4:]
+		bound = bound[:strings.Index(bound, `"`)]
+		count, err := strconv.ParseFloat(line[end+2:], 64)
+		if err != nil {
+			continue
+		}
+		result.LatencyBuckets[bound] += uint64(count)
+	}
+	return scanner.Err()
+}
+
+// latencyQuantile returns the upper bound of the histogram bucket holding quantile of the requests
+// counted since snapshot, false if there were none.
+func latencyQuantile(buckets map[string]uint64, snapshot map[string]uint64, quantile float64) (float64, bool) {
+	type bucket struct {
+		bound float64
+		count uint64
+	}
+	var deltas []bucket
+	for key, count := range buckets {
+		bound, err := strconv.ParseFloat(key, 64)
+		if err != nil {
+			continue
+		}
+		//histograms are reset when canary pods restart
+		if count < snapshot[key] {
+			return latencyQuantile(buckets, nil, quantile)
+		}
+		deltas = append(deltas, bucket{bound, count - snapshot[key]})
+	}
+	if len(deltas) == 0 {
+		return 0, false
+	}
+	sort.Slice(deltas, func(i, j int) bool {
+		return deltas[i].bound < deltas[j].bound
+	})
+	//buckets are cumulative, the last one (+Inf) counts all requests
+	total := deltas[len(deltas)-1].count
+	if total == 0 {
+		return 0, false
+	}
+	for _, b := range deltas {
+		if float64(b.count) >= quantile*float64(total) {
+			return b.bound, true
+		}
+	}
+	return math.Inf(1), true
+}
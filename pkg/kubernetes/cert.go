@@ -0,0 +1,269 @@
+package kubernetes
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"github.com/golang/glog"
+	"k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"math/big"
+	"sync"
+	"time"
+)
+
+const (
+	WEBHOOK_SECRET                   = "envoy-demo-webhook-certs"
+	WEBHOOK_CONFIGURATION            = "envoy-demo-inject-webhook"
+	VALIDATING_WEBHOOK_CONFIGURATION = "envoy-demo-validate-webhook"
+
+	CA_CERT_KEY      = "ca.crt"
+	CA_BUNDLE_KEY    = "ca-bundle.crt"
+	CA_KEY_KEY       = "ca.key"
+	SERVING_CERT_KEY = "tls.crt"
+	SERVING_KEY_KEY  = "tls.key"
+
+	CA_VALIDITY           = 10 * 365 * 24 * time.Hour
+	SERVING_CERT_VALIDITY = 90 * 24 * time.Hour
+	//serving certificates are renewed when less than this is left
+	CERT_RENEW_BEFORE   = 30 * 24 * time.Hour
+	CERT_CHECK_INTERVAL = 10 * time.Minute
+	CERT_RSA_BITS       = 2048
+)
+
+// WebhookCertManager keeps the CA and serving certificate of the webhook server in a Secret shared
+// by all control plane pods, renews the serving certificate before expiry and keeps caBundle
+// of the webhook configuration in sync.
+type WebhookCertManager struct {
+	k8sManager *K8sResourceManager
+	namespace  string
+	mutex      sync.RWMutex
+	serving    *tls.Certificate
+	secret     *v1.Secret
+	//caBundle last patched into the webhook configuration
+	patched []byte
+}
+
+func NewWebhookCertManager(k8sManager *K8sResourceManager) *WebhookCertManager {
+	result := &WebhookCertManager{
+		k8sManager: k8sManager,
+		namespace:  ControlPlaneNamespace(),
+	}
+	if err := result.sync(); err != nil {
+		if result.serving == nil {
+			panic(err.Error())
+		}
+		//caBundle patching is retried by Run
+		glog.Errorf("failed to sync webhook certificates: %s", err.Error())
+	}
+	return result
+}
+
+func (cm *WebhookCertManager) dnsNames() []string {
+	service := GetMeshConfig().ControlPlane.Service
+	return []string{
+		service,
+		fmt.Sprintf("%s.%s", service, cm.namespace),
+		fmt.Sprintf("%s.%s.svc", service, cm.namespace),
+		fmt.Sprintf("%s.%s.svc.cluster.local", service, cm.namespace),
+	}
+}
+
+// GetCertificate is used as tls.Config.GetCertificate so that renewed certificates are served without a restart.
+func (cm *WebhookCertManager) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+	return cm.serving, nil
+}
+
+func (cm *WebhookCertManager) CABundle() []byte {
+	cm.mutex.RLock()
+	defer cm.mutex.RUnlock()
+	return cm.secret.Data[CA_BUNDLE_KEY]
+}
+
+// sync loads the Secret, creates or renews the certificates in it if needed, and patches caBundle.
+func (cm *WebhookCertManager) sync() error {
+	secret, err := cm.k8sManager.GetSecret(cm.namespace, WEBHOOK_SECRET)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	if err != nil {
+		secret = &v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      WEBHOOK_SECRET,
+				Namespace: cm.namespace,
+			},
+			Type: v1.SecretTypeOpaque,
+		}
+	}
+	renewed, err := cm.renew(secret)
+	if err != nil {
+		return err
+	}
+	if renewed {
+		if secret.ResourceVersion == "" {
+			secret, err = cm.k8sManager.CreateSecret(secret)
+		} else {
+			secret, err = cm.k8sManager.UpdateSecret(secret)
+		}
+		if apierrors.IsAlreadyExists(err) || apierrors.IsConflict(err) {
+			//another control plane pod renewed it first
+			glog.Infof("Secret %s changed concurrently, reloading", WEBHOOK_SECRET)
+			return cm.sync()
+		}
+		if err != nil {
+			return err
+		}
+		glog.Infof("Renewed webhook certificates in secret %s", WEBHOOK_SECRET)
+	}
+
+	pair, err := tls.X509KeyPair(secret.Data[SERVING_CERT_KEY], secret.Data[SERVING_KEY_KEY])
+	if err != nil {
+		return err
+	}
+	cm.mutex.Lock()
+	cm.serving = &pair
+	cm.secret = secret
+	cm.mutex.Unlock()
+
+	caBundle := secret.Data[CA_BUNDLE_KEY]
+	if !bytes.Equal(cm.patched, caBundle) {
+		if err := cm.k8sManager.PatchWebhookCABundle(WEBHOOK_CONFIGURATION, caBundle); err != nil {
+			return err
+		}
+		if err := cm.k8sManager.PatchValidatingWebhookCABundle(VALIDATING_WEBHOOK_CONFIGURATION, caBundle); err != nil {
+			return err
+		}
+		cm.patched = caBundle
+		glog.Infof("Patched caBundle of %s and %s", WEBHOOK_CONFIGURATION, VALIDATING_WEBHOOK_CONFIGURATION)
+	}
+	return nil
+}
+
+// renew fills secret with new certificates if they are missing, invalid or about to expire.
+func (cm *WebhookCertManager) renew(secret *v1.Secret) (bool, error) {
+	if secret.Data == nil {
+		secret.Data = make(map[string][]byte)
+	}
+	now := time.Now()
+	caCert, caKey, err := parseCertAndKey(secret.Data[CA_CERT_KEY], secret.Data[CA_KEY_KEY])
+	renewCA := err != nil || now.Add(SERVING_CERT_VALIDITY).After(caCert.NotAfter)
+	if renewCA {
+		if err != nil && len(secret.Data[CA_CERT_KEY]) > 0 {
+			glog.Warningf("Invalid webhook CA in secret %s: %s", WEBHOOK_SECRET, err.Error())
+		}
+		oldCA := caCert
+		caCert, caKey, err = createCertificate(&x509.Certificate{
+			Subject:               pkix.Name{CommonName: fmt.Sprintf("%s-webhook-ca", GetMeshConfig().ControlPlane.Service)},
+			NotBefore:             now.Add(-time.Hour),
+			NotAfter:              now.Add(CA_VALIDITY),
+			KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+			BasicConstraintsValid: true,
+			IsCA:                  true,
+		}, nil, nil)
+		if err != nil {
+			return false, err
+		}
+		secret.Data[CA_CERT_KEY] = encodeCertificate(caCert)
+		secret.Data[CA_KEY_KEY] = encodePrivateKey(caKey)
+		//keep trusting the old CA until every control plane pod serves a certificate of the new one
+		secret.Data[CA_BUNDLE_KEY] = secret.Data[CA_CERT_KEY]
+		if oldCA != nil && now.Before(oldCA.NotAfter) {
+			secret.Data[CA_BUNDLE_KEY] = append(encodeCertificate(caCert), encodeCertificate(oldCA)...)
+		}
+	} else if len(secret.Data[CA_BUNDLE_KEY]) == 0 {
+		secret.Data[CA_BUNDLE_KEY] = secret.Data[CA_CERT_KEY]
+	}
+
+	if !renewCA {
+		servingCert, _, err := parseCertAndKey(secret.Data[SERVING_CERT_KEY], secret.Data[SERVING_KEY_KEY])
+		if err == nil && now.Add(CERT_RENEW_BEFORE).Before(servingCert.NotAfter) &&
+			servingCert.CheckSignatureFrom(caCert) == nil {
+			return false, nil
+		}
+	}
+	servingCert, servingKey, err := createCertificate(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: cm.dnsNames()[2]},
+		DNSNames:    cm.dnsNames(),
+		NotBefore:   now.Add(-time.Hour),
+		NotAfter:    now.Add(SERVING_CERT_VALIDITY),
+		KeyUsage:    x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, caCert, caKey)
+	if err != nil {
+		return false, err
+	}
+	secret.Data[SERVING_CERT_KEY] = encodeCertificate(servingCert)
+	secret.Data[SERVING_KEY_KEY] = encodePrivateKey(servingKey)
+	return true, nil
+}
+
+func (cm *WebhookCertManager) Run(stopper chan struct{}) {
+	wait.Until(func() {
+		if err := cm.sync(); err != nil {
+			glog.Errorf("failed to sync webhook certificates: %s", err.Error())
+		}
+	}, CERT_CHECK_INTERVAL, stopper)
+}
+
+// createCertificate signs template with parent, or self-signs it if parent is nil.
+func createCertificate(template *x509.Certificate, parent *x509.Certificate, parentKey *rsa.PrivateKey) (*x509.Certificate, *rsa.PrivateKey, error) {
+	key, err := rsa.GenerateKey(rand.Reader, CERT_RSA_BITS)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	template.SerialNumber = serial
+	if parent == nil {
+		parent = template
+		parentKey = key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+func parseCertAndKey(certPEM []byte, keyPEM []byte) (*x509.Certificate, *rsa.PrivateKey, error) {
+	certBlock, _ := pem.Decode(certPEM)
+	if certBlock == nil {
+		return nil, nil, fmt.Errorf("no certificate found")
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyBlock, _ := pem.Decode(keyPEM)
+	if keyBlock == nil {
+		return nil, nil, fmt.Errorf("no private key found")
+	}
+	key, err := x509.ParsePKCS1PrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+	return cert, key, nil
+}
+
+func encodeCertificate(cert *x509.Certificate) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw})
+}
+
+func encodePrivateKey(key *rsa.PrivateKey) []byte {
+	return pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+}
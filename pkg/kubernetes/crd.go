@@ -0,0 +1,43 @@
+package kubernetes
+
+import (
+	"encoding/json"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"time"
+)
+
+const (
+	CRD_GROUP         = "demo.envoy"
+	CRD_VERSION       = "v1alpha1"
+	CRD_POLL_INTERVAL = 10 * time.Second
+)
+
+// ListCustomResources lists the demo.envoy custom resources of the given plural
+// name in all namespaces and decodes the list into result.
+// A missing CustomResourceDefinition is treated as an empty list.
+func (manager *K8sResourceManager) ListCustomResources(plural string, result interface{}) error {
+	data, err := manager.clientSet.Discovery().RESTClient().Get().
+		AbsPath("/apis", CRD_GROUP, CRD_VERSION, plural).
+		DoRaw()
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil
+		}
+		return err
+	}
+	return json.Unmarshal(data, result)
+}
+
+// PatchCustomResource applies a merge patch to the named demo.envoy custom resource.
+func (manager *K8sResourceManager) PatchCustomResource(plural string, namespace string, name string, patch interface{}) error {
+	payloadBytes, err := json.Marshal(patch)
+	if err != nil {
+		return err
+	}
+	_, err = manager.clientSet.Discovery().RESTClient().Patch(types.MergePatchType).
+		AbsPath("/apis", CRD_GROUP, CRD_VERSION, "namespaces", namespace, plural, name).
+		Body(payloadBytes).
+		DoRaw()
+	return err
+}
@@ -0,0 +1,67 @@
+package kubernetes
+
+import (
+	"fmt"
+	"k8s.io/apimachinery/pkg/labels"
+	"strings"
+)
+
+const (
+	NAMESPACE_INJECTION_LABEL = "demo.envoy.injection"
+	INJECTION_ENABLED         = "enabled"
+	INJECTION_DISABLED        = "disabled"
+)
+
+type InjectionDecision struct {
+	Inject bool   `json:"inject"`
+	Reason string `json:"reason"`
+}
+
+func matchSelectors(selectors []string, podLabels map[string]string) string {
+	for _, selector := range selectors {
+		parsed, err := labels.Parse(selector)
+		if err != nil {
+			continue
+		}
+		if parsed.Matches(labels.Set(podLabels)) {
+			return selector
+		}
+	}
+	return ""
+}
+
+// DecideInjection decides whether the sidecar is injected into pod. The first matching rule wins:
+// host network and control plane pods, never/always inject selectors, pod annotation,
+// namespace label and at last whether the app is a known demo app.
+func DecideInjection(pod *PodInfo, namespaceLabels map[string]string, config *InjectionConfig) *InjectionDecision {
+	if pod.HostNetwork {
+		return &InjectionDecision{false, "pod uses host network"}
+	}
+	if pod.App() == GetMeshConfig().ControlPlane.Service {
+		return &InjectionDecision{false, "pod belongs to the control plane"}
+	}
+	if value, ok := pod.Annotations[ENVOY_ENABLE_ANNOTATION]; ok {
+		if pod.EnvoyAnnotated() {
+			return &InjectionDecision{true, fmt.Sprintf("pod annotation %s=%s", ENVOY_ENABLE_ANNOTATION, value)}
+		}
+		if strings.EqualFold(value, "false") {
+			return &InjectionDecision{false, fmt.Sprintf("pod annotation %s=%s", ENVOY_ENABLE_ANNOTATION, value)}
+		}
+	}
+	if selector := matchSelectors(config.NeverInjectSelectors, pod.Labels); selector != "" {
+		return &InjectionDecision{false, fmt.Sprintf("pod labels match never inject selector %s", selector)}
+	}
+	if selector := matchSelectors(config.AlwaysInjectSelectors, pod.Labels); selector != "" {
+		return &InjectionDecision{true, fmt.Sprintf("pod labels match always inject selector %s", selector)}
+	}
+	switch namespaceLabels[NAMESPACE_INJECTION_LABEL] {
+	case INJECTION_ENABLED:
+		return &InjectionDecision{true, fmt.Sprintf("namespace %s label %s=%s", pod.Namespace, NAMESPACE_INJECTION_LABEL, INJECTION_ENABLED)}
+	case INJECTION_DISABLED:
+		return &InjectionDecision{false, fmt.Sprintf("namespace %s label %s=%s", pod.Namespace, NAMESPACE_INJECTION_LABEL, INJECTION_DISABLED)}
+	}
+	if AppPort(pod.App()) != 0 {
+		return &InjectionDecision{true, fmt.Sprintf("app %s is a demo app", pod.App())}
+	}
+	return &InjectionDecision{false, fmt.Sprintf("app %s is not a demo app", pod.App())}
+}
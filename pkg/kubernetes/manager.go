@@ -2,15 +2,23 @@ package kubernetes
 
 import (
 	"encoding/json"
+	"fmt"
+	"github.com/golang/glog"
 	"k8s.io/api/core/v1"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/fields"
 	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
 	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/util/workqueue"
+	"os"
 	"reflect"
+	"sync"
 	"time"
 )
 
@@ -21,12 +29,29 @@ type PodEventHandler interface {
 	PodUpdated(oldPod, newPod *PodInfo)
 }
 
+const (
+	//period of informers replaying their cache to handlers, which repairs missed or failed updates
+	INFORMER_RESYNC_PERIOD = 5 * time.Minute
+	//retries of a pod whose handlers failed before waiting for its next event
+	POD_MAX_RETRIES = 5
+)
+
 type K8sResourceManager struct {
 	clientSet kubernetes.Interface
+	//informers shared by the watchers, started by each of them
+	informerFactory informers.SharedInformerFactory
 }
 
-func NewK8sResourceManager() (*K8sResourceManager, error) {
-	config, err := rest.InClusterConfig()
+// NewK8sResourceManager connects to the api server with kubeconfig, or with the in-cluster
+// config if kubeconfig is empty.
+func NewK8sResourceManager(kubeconfig string) (*K8sResourceManager, error) {
+	var config *rest.Config
+	var err error
+	if kubeconfig != "" {
+		config, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+	} else {
+		config, err = rest.InClusterConfig()
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -36,17 +61,62 @@ func NewK8sResourceManager() (*K8sResourceManager, error) {
 		return nil, err
 	}
 	result := &K8sResourceManager{
-		clientSet: clientSet,
+		clientSet:       clientSet,
+		informerFactory: informers.NewSharedInformerFactory(clientSet, INFORMER_RESYNC_PERIOD),
 	}
 
 	return result, nil
 }
-func (manager *K8sResourceManager) GetServiceClusterIP(name string, namespace string) (string, error) {
-	service, err := manager.clientSet.CoreV1().Services(namespace).Get(name, metav1.GetOptions{})
+func (manager *K8sResourceManager) GetConfigMap(namespace string, name string) (*v1.ConfigMap, error) {
+	return manager.clientSet.CoreV1().ConfigMaps(namespace).Get(name, metav1.GetOptions{})
+}
+
+func (manager *K8sResourceManager) GetSecret(namespace string, name string) (*v1.Secret, error) {
+	return manager.clientSet.CoreV1().Secrets(namespace).Get(name, metav1.GetOptions{})
+}
+
+func (manager *K8sResourceManager) CreateSecret(secret *v1.Secret) (*v1.Secret, error) {
+	return manager.clientSet.CoreV1().Secrets(secret.Namespace).Create(secret)
+}
+
+func (manager *K8sResourceManager) UpdateSecret(secret *v1.Secret) (*v1.Secret, error) {
+	return manager.clientSet.CoreV1().Secrets(secret.Namespace).Update(secret)
+}
+
+// PatchWebhookCABundle sets caBundle of every webhook in the MutatingWebhookConfiguration name.
+func (manager *K8sResourceManager) PatchWebhookCABundle(name string, caBundle []byte) error {
+	client := manager.clientSet.AdmissionregistrationV1beta1().MutatingWebhookConfigurations()
+	config, err := client.Get(name, metav1.GetOptions{})
 	if err != nil {
-		return "", err
+		return err
+	}
+	for i := range config.Webhooks {
+		config.Webhooks[i].ClientConfig.CABundle = caBundle
+	}
+	_, err = client.Update(config)
+	return err
+}
+
+// PatchValidatingWebhookCABundle sets caBundle of every webhook in the ValidatingWebhookConfiguration name.
+func (manager *K8sResourceManager) PatchValidatingWebhookCABundle(name string, caBundle []byte) error {
+	client := manager.clientSet.AdmissionregistrationV1beta1().ValidatingWebhookConfigurations()
+	config, err := client.Get(name, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	for i := range config.Webhooks {
+		config.Webhooks[i].ClientConfig.CABundle = caBundle
+	}
+	_, err = client.Update(config)
+	return err
+}
+
+func (manager *K8sResourceManager) GetNamespaceLabels(name string) (map[string]string, error) {
+	namespace, err := manager.clientSet.CoreV1().Namespaces().Get(name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
 	}
-	return service.Spec.ClusterIP, nil
+	return namespace.Labels, nil
 }
 
 func (manager *K8sResourceManager) GetPodAnnotation(key string, podInfo *PodInfo) (string, error) {
@@ -72,6 +142,39 @@ func (manager *K8sResourceManager) PodExists(name string, ns string) (bool, erro
 	return true, nil
 }
 
+func (manager *K8sResourceManager) ListPods(namespace string, selector string) ([]*PodInfo, error) {
+	podList, err := manager.clientSet.CoreV1().Pods(namespace).List(metav1.ListOptions{LabelSelector: selector})
+	if err != nil {
+		return nil, err
+	}
+	var result []*PodInfo
+	for i := range podList.Items {
+		result = append(result, NewPodInfo(&podList.Items[i]))
+	}
+	return result, nil
+}
+
+// ControlPlanePeers returns the ips of the other ready pods of the control plane.
+func (manager *K8sResourceManager) ControlPlanePeers() ([]string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	selector := fmt.Sprintf("%s=%s", APP_LABEL, GetMeshConfig().ControlPlane.Service)
+	pods, err := manager.ListPods(ControlPlaneNamespace(), selector)
+	if err != nil {
+		return nil, err
+	}
+	var result []string
+	for _, pod := range pods {
+		if pod.Name == hostname || pod.PodIP == "" || !pod.Ready {
+			continue
+		}
+		result = append(result, pod.PodIP)
+	}
+	return result, nil
+}
+
 func (manager *K8sResourceManager) SetPodAnnotation(annotations map[string]string, podInfo *PodInfo) error {
 	payload := map[string]interface{}{
 		"metadata": map[string]interface{}{
@@ -84,57 +187,166 @@ func (manager *K8sResourceManager) SetPodAnnotation(annotations map[string]strin
 	return err
 }
 
+func (manager *K8sResourceManager) RecordEvent(object *v1.ObjectReference, eventType string, reason string, message string) error {
+	now := metav1.Now()
+	event := &v1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: fmt.Sprintf("%s.", object.Name),
+			Namespace:    object.Namespace,
+		},
+		InvolvedObject: *object,
+		Reason:         reason,
+		Message:        message,
+		Type:           eventType,
+		Source: v1.EventSource{
+			Component: GetMeshConfig().ControlPlane.Service,
+		},
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+	}
+	_, err := manager.clientSet.CoreV1().Events(object.Namespace).Create(event)
+	return err
+}
+
+// callPodHandlers runs fn, a panic of a handler is returned as error so that the pod is retried
+// instead of crashing the server.
+func callPodHandlers(fn func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("handler panic: %v", r)
+		}
+	}()
+	fn()
+	return nil
+}
+
+// podWatcher turns informer events into pod keys on a rate limited queue, and a worker compares
+// the cached pod of each key with the one last delivered to handlers.
+type podWatcher struct {
+	lister   corelisters.PodLister
+	queue    workqueue.RateLimitingInterface
+	handlers []PodEventHandler
+	mutex    sync.Mutex
+	//namespace/name -> pod last delivered to handlers
+	delivered map[string]*PodInfo
+}
+
+func (watcher *podWatcher) enqueue(obj interface{}) {
+	//also handles the DeletedFinalStateUnknown tombstones of deletes missed during a watch gap
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		glog.Errorf("failed to get key of pod %v: %s", obj, err.Error())
+		return
+	}
+	watcher.queue.Add(key)
+}
+
+// enqueueDelivered queues every pod delivered to handlers, deleted pods whose events were lost
+// are removed this way.
+func (watcher *podWatcher) enqueueDelivered() {
+	watcher.mutex.Lock()
+	defer watcher.mutex.Unlock()
+	for key := range watcher.delivered {
+		watcher.queue.Add(key)
+	}
+}
+
+func (watcher *podWatcher) sync(key string) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+	watcher.mutex.Lock()
+	oldPod := watcher.delivered[key]
+	watcher.mutex.Unlock()
+
+	rawPod, err := watcher.lister.Pods(namespace).Get(name)
+	if apierrors.IsNotFound(err) {
+		if oldPod != nil {
+			if err := callPodHandlers(func() { notifyPodDeleted(watcher.handlers, oldPod) }); err != nil {
+				return err
+			}
+		}
+		watcher.mutex.Lock()
+		delete(watcher.delivered, key)
+		watcher.mutex.Unlock()
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	newPod := NewPodInfo(rawPod)
+	if oldPod == nil {
+		err = callPodHandlers(func() { notifyPodAdded(watcher.handlers, newPod) })
+	} else {
+		newVersion := newPod.ResourceVersion
+		//ignore ResourceVersion diff, e.g. on resync
+		newPod.ResourceVersion = oldPod.ResourceVersion
+		if reflect.DeepEqual(oldPod, newPod) {
+			return nil
+		}
+		newPod.ResourceVersion = newVersion
+		err = callPodHandlers(func() { notifyPodUpdated(watcher.handlers, oldPod, newPod) })
+	}
+	if err != nil {
+		return err
+	}
+	watcher.mutex.Lock()
+	watcher.delivered[key] = newPod
+	watcher.mutex.Unlock()
+	return nil
+}
+
+func (watcher *podWatcher) processNextItem() bool {
+	item, shutdown := watcher.queue.Get()
+	if shutdown {
+		return false
+	}
+	defer watcher.queue.Done(item)
+	key := item.(string)
+	err := watcher.sync(key)
+	if err == nil {
+		watcher.queue.Forget(item)
+	} else if watcher.queue.NumRequeues(item) < POD_MAX_RETRIES {
+		glog.Warningf("failed to process pod %s, retrying: %s", key, err.Error())
+		watcher.queue.AddRateLimited(item)
+	} else {
+		//the next event or resync of the pod tries again
+		glog.Errorf("failed to process pod %s, giving up: %s", key, err.Error())
+		watcher.queue.Forget(item)
+	}
+	return true
+}
+
 func (manager *K8sResourceManager) WatchPods(stopper chan struct{}, handlers ...PodEventHandler) {
-	watchlist := cache.NewListWatchFromClient(
-		manager.clientSet.Core().RESTClient(), "pods", "",
-		fields.Everything())
-	_, controller := cache.NewInformer(
-		watchlist,
-		&v1.Pod{},
-		time.Second*0,
-		cache.ResourceEventHandlerFuncs{
-			AddFunc: func(obj interface{}) {
-				pod := NewPodInfo(obj.(*v1.Pod))
-				for _, h := range handlers {
-					if h.PodValid(pod) {
-						h.PodAdded(pod)
-					}
-				}
-			},
-			DeleteFunc: func(obj interface{}) {
-				pod := NewPodInfo(obj.(*v1.Pod))
-				for _, h := range handlers {
-					if h.PodValid(pod) {
-						h.PodDeleted(pod)
-					}
-				}
-			},
-			UpdateFunc: func(oldObj, newObj interface{}) {
-				oldPod := NewPodInfo(oldObj.(*v1.Pod))
-				newPod := NewPodInfo(newObj.(*v1.Pod))
-
-				if oldPod != nil && newPod != nil {
-					newVersion := newPod.ResourceVersion
-					//ignore ResourceVersion diff
-					newPod.ResourceVersion = oldPod.ResourceVersion
-					if reflect.DeepEqual(oldPod, newPod) {
-						return
-					}
-					newPod.ResourceVersion = newVersion
-				}
-				for _, h := range handlers {
-					oldValid := (h.PodValid(oldPod))
-					newValid := (h.PodValid(newPod))
-					if !oldValid && newValid {
-						h.PodAdded(newPod)
-					} else if oldValid && !newValid {
-						h.PodDeleted(oldPod)
-					} else if oldValid && newValid {
-						h.PodUpdated(oldPod, newPod)
-					}
-				}
-			},
+	informer := manager.informerFactory.Core().V1().Pods()
+	watcher := &podWatcher{
+		lister:    informer.Lister(),
+		queue:     workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), "pods"),
+		handlers:  handlers,
+		delivered: make(map[string]*PodInfo),
+	}
+	defer watcher.queue.ShutDown()
+
+	informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: watcher.enqueue,
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			watcher.enqueue(newObj)
 		},
-	)
-	controller.Run(stopper)
+		DeleteFunc: watcher.enqueue,
+	})
+	manager.informerFactory.Start(stopper)
+	if !cache.WaitForCacheSync(stopper, informer.Informer().HasSynced) {
+		glog.Errorf("failed to sync pods cache")
+		return
+	}
+	//a single worker keeps the events of a pod in order
+	go wait.Until(func() {
+		for watcher.processNextItem() {
+		}
+	}, time.Second, stopper)
+	go wait.Until(watcher.enqueueDelivered, INFORMER_RESYNC_PERIOD, stopper)
+	<-stopper
 }
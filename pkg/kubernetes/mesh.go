@@ -0,0 +1,395 @@
+package kubernetes
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/golang/glog"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	OUTBOUND_ALLOW_ANY     = "ALLOW_ANY"
+	OUTBOUND_REGISTRY_ONLY = "REGISTRY_ONLY"
+
+	TRACING_ZIPKIN        = "zipkin"
+	TRACING_JAEGER        = "jaeger"
+	TRACING_OPENTELEMETRY = "opentelemetry"
+	TRACING_NONE          = "none"
+
+	//span endpoints of the zipkin compatible receivers, the proxy only ships a zipkin tracer
+	ZIPKIN_COLLECTOR_ENDPOINT        = "/api/v2/spans"
+	JAEGER_COLLECTOR_ENDPOINT        = "/api/v2/spans"
+	OPENTELEMETRY_COLLECTOR_ENDPOINT = "/api/v2/spans"
+
+	DEFAULT_PROXY_READY_TIMEOUT = time.Minute
+	DEFAULT_DRAIN_DURATION      = 5 * time.Second
+	DEFAULT_CONNECT_TIMEOUT     = 60 * time.Second
+	MESH_CONFIG_POLL_INTERVAL   = 5 * time.Second
+)
+
+type AccessLogConfig struct {
+	//file path like /dev/stdout, empty to disable file access log
+	File   string `yaml:"file"`
+	Format string `yaml:"format"`
+	//send access logs to the access log service of envoy-demo
+	Grpc bool `yaml:"grpc"`
+}
+
+// sampling percentages, nil means envoy default
+type SamplingConfig struct {
+	Client  *float64 `yaml:"client"`
+	Random  *float64 `yaml:"random"`
+	Overall *float64 `yaml:"overall"`
+}
+
+func (sampling SamplingConfig) merge(override SamplingConfig) SamplingConfig {
+	if override.Client != nil {
+		sampling.Client = override.Client
+	}
+	if override.Random != nil {
+		sampling.Random = override.Random
+	}
+	if override.Overall != nil {
+		sampling.Overall = override.Overall
+	}
+	return sampling
+}
+
+func (sampling SamplingConfig) Validate() error {
+	for _, value := range []*float64{sampling.Client, sampling.Random, sampling.Overall} {
+		if value != nil && (*value < 0 || *value > 100) {
+			return fmt.Errorf("sampling percentage %f is not in [0, 100]", *value)
+		}
+	}
+	return nil
+}
+
+type TracingConfig struct {
+	//zipkin, jaeger, opentelemetry or none.
+	//jaeger and opentelemetry collectors are reached through their zipkin compatible receivers
+	Driver  string `yaml:"driver"`
+	Service string `yaml:"service"`
+	Port    uint32 `yaml:"port"`
+	//path spans are posted to, defaults to the one of the driver
+	CollectorEndpointOverride string         `yaml:"collectorEndpoint"`
+	Sampling                  SamplingConfig `yaml:"sampling"`
+	//sampling of requests received by a service
+	Services map[string]SamplingConfig `yaml:"services"`
+	//sampling of requests sent to a host
+	Routes map[string]SamplingConfig `yaml:"routes"`
+	//request headers recorded as span tags
+	CustomTags []string `yaml:"customTags"`
+}
+
+func (config *TracingConfig) Enabled() bool {
+	return config.Driver != TRACING_NONE
+}
+
+func (config *TracingConfig) CollectorEndpoint() string {
+	if config.CollectorEndpointOverride != "" {
+		return config.CollectorEndpointOverride
+	}
+	switch config.Driver {
+	case TRACING_JAEGER:
+		return JAEGER_COLLECTOR_ENDPOINT
+	case TRACING_OPENTELEMETRY:
+		return OPENTELEMETRY_COLLECTOR_ENDPOINT
+	}
+	return ZIPKIN_COLLECTOR_ENDPOINT
+}
+
+// ServiceSampling returns the global sampling overridden by the one of service.
+func (config *TracingConfig) ServiceSampling(service string) SamplingConfig {
+	return config.Sampling.merge(config.Services[service])
+}
+
+func (config *TracingConfig) Validate() error {
+	switch config.Driver {
+	case TRACING_ZIPKIN, TRACING_JAEGER, TRACING_OPENTELEMETRY, TRACING_NONE:
+	default:
+		return fmt.Errorf("unknown tracing driver %s", config.Driver)
+	}
+	if endpoint := config.CollectorEndpointOverride; endpoint != "" && !strings.HasPrefix(endpoint, "/") {
+		return fmt.Errorf("tracing collectorEndpoint %s must start with /", endpoint)
+	}
+	if config.Enabled() && (config.Service == "" || config.Port == 0) {
+		return fmt.Errorf("tracing service and port are required")
+	}
+	if err := config.Sampling.Validate(); err != nil {
+		return err
+	}
+	for service, sampling := range config.Services {
+		if err := sampling.Validate(); err != nil {
+			return fmt.Errorf("service %s: %s", service, err.Error())
+		}
+	}
+	for host, sampling := range config.Routes {
+		if err := sampling.Validate(); err != nil {
+			return fmt.Errorf("route %s: %s", host, err.Error())
+		}
+	}
+	return nil
+}
+
+type InjectionConfig struct {
+	//label selectors of pods always or never injected, never wins, the enable annotation of a pod overrides both
+	AlwaysInjectSelectors []string `yaml:"alwaysInjectSelectors"`
+	NeverInjectSelectors  []string `yaml:"neverInjectSelectors"`
+}
+
+func (config *InjectionConfig) Validate() error {
+	for _, selector := range append(config.AlwaysInjectSelectors, config.NeverInjectSelectors...) {
+		//an empty selector matches every pod
+		if strings.TrimSpace(selector) == "" {
+			return fmt.Errorf("empty selector")
+		}
+		if _, err := labels.Parse(selector); err != nil {
+			return fmt.Errorf("invalid selector %s: %s", selector, err.Error())
+		}
+	}
+	return nil
+}
+
+type LifecycleConfig struct {
+	//start application containers only after envoy received its listeners and clusters
+	HoldApplicationUntilProxyStarts bool          `yaml:"holdApplicationUntilProxyStarts"`
+	ProxyReadyTimeout               time.Duration `yaml:"proxyReadyTimeout"`
+	//how long envoy drains connections on termination before it exits
+	DrainDuration time.Duration `yaml:"drainDuration"`
+}
+
+func (config *LifecycleConfig) Validate() error {
+	if config.ProxyReadyTimeout <= 0 {
+		return fmt.Errorf("proxyReadyTimeout must be positive")
+	}
+	if config.DrainDuration < 0 {
+		return fmt.Errorf("drainDuration must not be negative")
+	}
+	return nil
+}
+
+type ControlPlaneConfig struct {
+	Service string `yaml:"service"`
+	//grpc port of the control plane, changes require a restart
+	Port uint32 `yaml:"port"`
+}
+
+type ProxyConfig struct {
+	ListenPort uint32 `yaml:"listenPort"`
+	ManagePort uint32 `yaml:"managePort"`
+	UID        int64  `yaml:"uid"`
+}
+
+func validPort(port uint32) bool {
+	return port > 0 && port <= 65535
+}
+
+type MeshConfig struct {
+	AppNamespace string `yaml:"appNamespace"`
+	//port of each mesh app, changes require a restart
+	Apps                  map[string]uint32  `yaml:"apps"`
+	ControlPlane          ControlPlaneConfig `yaml:"controlPlane"`
+	Proxy                 ProxyConfig        `yaml:"proxy"`
+	ConnectTimeout        time.Duration      `yaml:"connectTimeout"`
+	OutboundTrafficPolicy string             `yaml:"outboundTrafficPolicy"`
+	AccessLog             AccessLogConfig    `yaml:"accessLog"`
+	Tracing               TracingConfig      `yaml:"tracing"`
+	Injection             InjectionConfig    `yaml:"injection"`
+	Lifecycle             LifecycleConfig    `yaml:"lifecycle"`
+}
+
+var meshConfig atomic.Value
+
+func init() {
+	meshConfig.Store(NewMeshConfig())
+}
+
+func NewMeshConfig() *MeshConfig {
+	apps := make(map[string]uint32)
+	for app, port := range DemoAppSet {
+		apps[app] = port
+	}
+	return &MeshConfig{
+		AppNamespace: APP_NAMESPACE,
+		Apps:         apps,
+		ControlPlane: ControlPlaneConfig{
+			Service: CONTROL_PLANE_SERVICE,
+			Port:    CONTROL_PLANE_PORT,
+		},
+		Proxy: ProxyConfig{
+			ListenPort: ENVOY_LISTEN_PORT,
+			ManagePort: MANAGE_PORT,
+			UID:        PROXY_UID,
+		},
+		ConnectTimeout:        DEFAULT_CONNECT_TIMEOUT,
+		OutboundTrafficPolicy: OUTBOUND_REGISTRY_ONLY,
+		Tracing: TracingConfig{
+			Driver:  TRACING_ZIPKIN,
+			Service: ZIPKIN_SERVICE,
+			Port:    ZIPKIN_PORT,
+		},
+		Lifecycle: LifecycleConfig{
+			HoldApplicationUntilProxyStarts: true,
+			ProxyReadyTimeout:               DEFAULT_PROXY_READY_TIMEOUT,
+			DrainDuration:                   DEFAULT_DRAIN_DURATION,
+		},
+	}
+}
+
+// GetMeshConfig returns the current mesh config, which must not be modified.
+func GetMeshConfig() *MeshConfig {
+	return meshConfig.Load().(*MeshConfig)
+}
+
+// AppPort returns the port of a mesh app, 0 if app is not in the mesh.
+func AppPort(app string) uint32 {
+	return GetMeshConfig().Apps[app]
+}
+
+func (config *MeshConfig) Validate() error {
+	if config.AppNamespace == "" {
+		return fmt.Errorf("appNamespace is empty")
+	}
+	if len(config.Apps) == 0 {
+		return fmt.Errorf("no apps defined")
+	}
+	for app, port := range config.Apps {
+		if !validPort(port) {
+			return fmt.Errorf("invalid port %d of app %s", port, app)
+		}
+	}
+	if config.ControlPlane.Service == "" || !validPort(config.ControlPlane.Port) {
+		return fmt.Errorf("invalid controlPlane %s:%d", config.ControlPlane.Service, config.ControlPlane.Port)
+	}
+	if !validPort(config.Proxy.ListenPort) || !validPort(config.Proxy.ManagePort) {
+		return fmt.Errorf("invalid proxy ports %d, %d", config.Proxy.ListenPort, config.Proxy.ManagePort)
+	}
+	if config.Proxy.ListenPort == config.Proxy.ManagePort {
+		return fmt.Errorf("proxy listenPort and managePort are both %d", config.Proxy.ListenPort)
+	}
+	if config.Proxy.UID <= 0 {
+		return fmt.Errorf("proxy uid must be positive")
+	}
+	if config.ConnectTimeout <= 0 {
+		return fmt.Errorf("connectTimeout must be positive")
+	}
+	switch config.OutboundTrafficPolicy {
+	case OUTBOUND_ALLOW_ANY, OUTBOUND_REGISTRY_ONLY:
+	default:
+		return fmt.Errorf("unknown outboundTrafficPolicy %s", config.OutboundTrafficPolicy)
+	}
+	if err := config.Tracing.Validate(); err != nil {
+		return fmt.Errorf("tracing: %s", err.Error())
+	}
+	if err := config.Injection.Validate(); err != nil {
+		return fmt.Errorf("injection: %s", err.Error())
+	}
+	if err := config.Lifecycle.Validate(); err != nil {
+		return fmt.Errorf("lifecycle: %s", err.Error())
+	}
+	return nil
+}
+
+type MeshConfigEventHandler interface {
+	MeshConfigChanged(oldConfig, newConfig *MeshConfig)
+}
+
+// MeshConfigLoader loads the mesh config file, applies the command line overrides, and
+// reloads it when the file changes, e.g. when the mounted ConfigMap is updated.
+type MeshConfigLoader struct {
+	path     string
+	override func(config *MeshConfig)
+	data     []byte
+	loaded   bool
+}
+
+func NewMeshConfigLoader(path string, override func(config *MeshConfig)) *MeshConfigLoader {
+	return &MeshConfigLoader{path: path, override: override}
+}
+
+func (loader *MeshConfigLoader) parse(data []byte) (*MeshConfig, error) {
+	config := NewMeshConfig()
+	defaultApps := config.Apps
+	//apps of the file replace the default ones instead of being merged into them
+	config.Apps = nil
+	if err := yaml.UnmarshalStrict(data, config); err != nil {
+		return nil, err
+	}
+	if len(config.Apps) == 0 {
+		config.Apps = defaultApps
+	}
+	if loader.override != nil {
+		loader.override(config)
+	}
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// Load reads the config file, returns whether the config changed.
+func (loader *MeshConfigLoader) Load() (bool, error) {
+	var data []byte
+	if loader.path != "" {
+		var err error
+		data, err = ioutil.ReadFile(loader.path)
+		if err != nil {
+			return false, err
+		}
+	}
+	if loader.loaded && bytes.Equal(data, loader.data) {
+		return false, nil
+	}
+	//an invalid file is reported once, not on every poll
+	loader.data = data
+	config, err := loader.parse(data)
+	if err != nil {
+		return false, err
+	}
+	if loader.loaded {
+		current := GetMeshConfig()
+		//the iptables rules and containers of running pods keep the proxy settings they were created with
+		if !reflect.DeepEqual(current.Apps, config.Apps) || current.ControlPlane.Port != config.ControlPlane.Port ||
+			current.Proxy != config.Proxy {
+			glog.Warningf("apps, controlPlane.port and proxy changes of %s take effect after a restart", loader.path)
+			config.Apps = current.Apps
+			config.ControlPlane.Port = current.ControlPlane.Port
+			config.Proxy = current.Proxy
+		}
+	}
+	loader.loaded = true
+	if reflect.DeepEqual(GetMeshConfig(), config) {
+		return false, nil
+	}
+	meshConfig.Store(config)
+	return true, nil
+}
+
+// Watch polls the config file and notifies handlers of valid changes, invalid files are ignored.
+func (loader *MeshConfigLoader) Watch(stopper chan struct{}, handlers ...MeshConfigEventHandler) {
+	if loader.path == "" {
+		return
+	}
+	wait.Until(func() {
+		oldConfig := GetMeshConfig()
+		changed, err := loader.Load()
+		if err != nil {
+			glog.Errorf("failed to reload mesh config %s, keep the current one: %s", loader.path, err.Error())
+			return
+		}
+		if !changed {
+			return
+		}
+		glog.Infof("Mesh config %s reloaded", loader.path)
+		for _, h := range handlers {
+			h.MeshConfigChanged(oldConfig, GetMeshConfig())
+		}
+	}, MESH_CONFIG_POLL_INTERVAL, stopper)
+}
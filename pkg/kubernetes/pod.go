@@ -2,6 +2,7 @@ package kubernetes
 
 import (
 	"fmt"
+	"github.com/golang/glog"
 	"k8s.io/api/core/v1"
 	"strconv"
 	"strings"
@@ -11,12 +12,17 @@ const (
 	ENDPOINT_WEIGHT_ANNOTATION = "demo.envoy.weight"
 	ENVOY_PROXY_ANNOTATION     = "demo.envoy.proxy"
 	ENVOY_ENABLE_ANNOTATION    = "demo.envoy.enabled"
+	ENDPOINT_DRAIN_ANNOTATION  = "demo.envoy.drain"
+	APP_LABEL                  = "app"
+	VERSION_LABEL              = "version"
 	DEFAULT_WEIGHT             = 100
+	MAX_WEIGHT                 = 128
 
 	APP_NAMESPACE         = "default"
 	APP_PORT              = 9080
 	CONTROL_PLANE_PORT    = 15010
 	CONTROL_PLANE_SERVICE = "envoy-demo"
+	DEBUG_PORT            = 15014
 	MANAGE_PORT           = 15000
 	ENVOY_LISTEN_PORT     = 10000
 	PROXY_UID             = 1337
@@ -35,6 +41,7 @@ var (
 
 type PodInfo struct {
 	ResourceVersion string
+	UID             string
 	Name            string
 	Namespace       string
 	PodIP           string
@@ -44,10 +51,20 @@ type PodInfo struct {
 	HostNetwork     bool
 	Containers      []string
 	ContainerPorts  []uint32
+	//Ready condition is true and all containers are ready
+	Ready bool
+	//deletionTimestamp is set, the pod is shutting down
+	Terminating bool
+	//restarts of all containers
+	Restarts int32
 }
 
 func (pod *PodInfo) App() string {
-	return pod.Labels["app"]
+	return pod.Labels[APP_LABEL]
+}
+
+func (pod *PodInfo) Version() string {
+	return pod.Labels[VERSION_LABEL]
 }
 
 func GetLabelValueUInt32(value string) uint32 {
@@ -61,19 +78,25 @@ func GetLabelValueUInt32(value string) uint32 {
 	return uint32(i)
 }
 
+// Weight returns the endpoint weight annotation of the pod. An invalid value, which the webhook lets
+// through while it is unavailable, falls back to the default instead of taking the endpoint out.
 func (pod *PodInfo) Weight() uint32 {
-	if pod.Annotations != nil {
-		value := pod.Annotations[ENDPOINT_WEIGHT_ANNOTATION]
-		if value != "" {
-			result := GetLabelValueUInt32(value)
-			if result > 128 {
-				return 128
-			} else {
-				return result
-			}
-		}
+	value, ok := pod.Annotations[ENDPOINT_WEIGHT_ANNOTATION]
+	if !ok || value == "" {
+		return DEFAULT_WEIGHT
 	}
-	return DEFAULT_WEIGHT
+	result, err := ParseWeight(value)
+	if err != nil {
+		glog.Warningf("%s: %s, using weight %d", pod.String(), err.Error(), DEFAULT_WEIGHT)
+		return DEFAULT_WEIGHT
+	}
+	return result
+}
+
+// Draining tells whether new requests should no longer be sent to the pod, because it is terminating
+// or has been drained manually by annotation.
+func (pod *PodInfo) Draining() bool {
+	return pod.Terminating || strings.EqualFold(pod.Annotations[ENDPOINT_DRAIN_ANNOTATION], "true")
 }
 
 func (pod *PodInfo) EnvoyDockerId() string {
@@ -95,9 +118,25 @@ func (pod *PodInfo) String() string {
 		pod.Name, pod.Namespace, pod.PodIP)
 }
 
+// podReady returns whether the Ready condition of pod is true and all of its containers are ready.
+func podReady(pod *v1.Pod) bool {
+	ready := false
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == v1.PodReady {
+			ready = condition.Status == v1.ConditionTrue
+		}
+	}
+	for _, container := range pod.Status.ContainerStatuses {
+		ready = ready && container.Ready
+	}
+	return ready
+}
+
 func NewPodInfo(pod *v1.Pod) *PodInfo {
 	var containers []string
+	var restarts int32
 	for _, container := range pod.Status.ContainerStatuses {
+		restarts += container.RestartCount
 		id := container.ContainerID
 		if strings.HasPrefix(id, "docker://") {
 			id = id[9:]
@@ -113,8 +152,12 @@ func NewPodInfo(pod *v1.Pod) *PodInfo {
 		Annotations:     pod.Annotations,
 		Labels:          pod.Labels,
 		ResourceVersion: pod.ResourceVersion,
+		UID:             string(pod.UID),
 		HostNetwork:     pod.Spec.HostNetwork,
 		Containers:      containers,
+		Ready:           podReady(pod),
+		Terminating:     pod.DeletionTimestamp != nil,
+		Restarts:        restarts,
 	}
 	if result.Annotations == nil {
 		result.Annotations = make(map[string]string)
@@ -0,0 +1,198 @@
+package kubernetes
+
+import (
+	"bytes"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"net"
+	"reflect"
+	"time"
+
+	"github.com/ghodss/yaml"
+	"github.com/golang/glog"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+const (
+	REGISTRY_KUBERNETES         = "kubernetes"
+	REGISTRY_FILE               = "file"
+	FILE_REGISTRY_POLL_INTERVAL = 5 * time.Second
+)
+
+// Registry is the source of the pods of the mesh.
+type Registry interface {
+	WatchPods(stopper chan struct{}, handlers ...PodEventHandler)
+}
+
+func notifyPodAdded(handlers []PodEventHandler, pod *PodInfo) {
+	for _, h := range handlers {
+		if h.PodValid(pod) {
+			h.PodAdded(pod)
+		}
+	}
+}
+
+func notifyPodDeleted(handlers []PodEventHandler, pod *PodInfo) {
+	for _, h := range handlers {
+		if h.PodValid(pod) {
+			h.PodDeleted(pod)
+		}
+	}
+}
+
+func notifyPodUpdated(handlers []PodEventHandler, oldPod *PodInfo, newPod *PodInfo) {
+	//handlers key their resources by pod ip, so a pod recreated under the same name, whose events were
+	//merged by the work queue, or a pod moved to another ip is replaced instead of updated
+	if oldPod.UID != newPod.UID || oldPod.PodIP != newPod.PodIP {
+		notifyPodDeleted(handlers, oldPod)
+		notifyPodAdded(handlers, newPod)
+		return
+	}
+	for _, h := range handlers {
+		oldValid := (h.PodValid(oldPod))
+		newValid := (h.PodValid(newPod))
+		if !oldValid && newValid {
+			h.PodAdded(newPod)
+		} else if oldValid && !newValid {
+			h.PodDeleted(oldPod)
+		} else if oldValid && newValid {
+			h.PodUpdated(oldPod, newPod)
+		}
+	}
+}
+
+type FileEndpoint struct {
+	//pod name, the node id of the envoy running beside it
+	Name        string            `json:"name"`
+	IP          string            `json:"ip"`
+	Version     string            `json:"version,omitempty"`
+	Weight      *uint32           `json:"weight,omitempty"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+}
+
+type FileService struct {
+	//app name, its port comes from the mesh config
+	Name      string         `json:"name"`
+	Namespace string         `json:"namespace,omitempty"`
+	Endpoints []FileEndpoint `json:"endpoints"`
+}
+
+type FileRegistryConfig struct {
+	Services []FileService `json:"services"`
+}
+
+// FileRegistry reads services and their endpoints from a yaml or json file instead of the
+// kubernetes api server, so that the control plane can run outside of a cluster.
+type FileRegistry struct {
+	path string
+	data []byte
+	pods map[string]*PodInfo
+}
+
+func NewFileRegistry(path string) *FileRegistry {
+	return &FileRegistry{path: path, pods: make(map[string]*PodInfo)}
+}
+
+func (registry *FileRegistry) parse(data []byte) (map[string]*PodInfo, error) {
+	config := &FileRegistryConfig{}
+	if err := yaml.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+	result := make(map[string]*PodInfo)
+	for _, service := range config.Services {
+		if service.Name == "" {
+			return nil, fmt.Errorf("service name is empty")
+		}
+		if AppPort(service.Name) == 0 {
+			glog.Warningf("service %s of %s is not an app of the mesh config, its endpoints are ignored", service.Name, registry.path)
+		}
+		namespace := service.Namespace
+		if namespace == "" {
+			namespace = GetMeshConfig().AppNamespace
+		}
+		for _, endpoint := range service.Endpoints {
+			if endpoint.Name == "" {
+				return nil, fmt.Errorf("endpoint of service %s has no name", service.Name)
+			}
+			if result[endpoint.Name] != nil {
+				return nil, fmt.Errorf("duplicate endpoint name %s", endpoint.Name)
+			}
+			if net.ParseIP(endpoint.IP) == nil {
+				return nil, fmt.Errorf("endpoint %s has invalid ip %q", endpoint.Name, endpoint.IP)
+			}
+			pod := &PodInfo{
+				Name:        endpoint.Name,
+				Namespace:   namespace,
+				PodIP:       endpoint.IP,
+				Annotations: make(map[string]string),
+				Labels:      map[string]string{APP_LABEL: service.Name},
+				//endpoints of the file are always ready, use the drain annotation to take one out
+				Ready: true,
+			}
+			for key, value := range endpoint.Annotations {
+				if err := ValidateAnnotation(key, value); err != nil {
+					return nil, fmt.Errorf("endpoint %s: %s", endpoint.Name, err.Error())
+				}
+				pod.Annotations[key] = value
+			}
+			if endpoint.Weight != nil {
+				if *endpoint.Weight > MAX_WEIGHT {
+					return nil, fmt.Errorf("endpoint %s: weight %d is above %d", endpoint.Name, *endpoint.Weight, MAX_WEIGHT)
+				}
+				pod.Annotations[ENDPOINT_WEIGHT_ANNOTATION] = fmt.Sprint(*endpoint.Weight)
+			}
+			if endpoint.Version != "" {
+				pod.Labels[VERSION_LABEL] = endpoint.Version
+			}
+			//the resource version changes whenever the endpoint does, like the one of a pod
+			h := fnv.New32a()
+			h.Write([]byte(fmt.Sprintf("%s|%v|%v", pod.PodIP, pod.Labels, pod.Annotations)))
+			pod.ResourceVersion = fmt.Sprint(h.Sum32())
+			result[pod.Name] = pod
+		}
+	}
+	return result, nil
+}
+
+// sync reads the file and notifies handlers of the added, deleted and updated endpoints.
+func (registry *FileRegistry) sync(handlers []PodEventHandler) error {
+	data, err := ioutil.ReadFile(registry.path)
+	if err != nil {
+		return err
+	}
+	if registry.data != nil && bytes.Equal(data, registry.data) {
+		return nil
+	}
+	//an invalid file is reported once, not on every poll
+	registry.data = data
+	pods, err := registry.parse(data)
+	if err != nil {
+		return err
+	}
+	for name, oldPod := range registry.pods {
+		if pods[name] == nil {
+			notifyPodDeleted(handlers, oldPod)
+		}
+	}
+	for name, pod := range pods {
+		oldPod := registry.pods[name]
+		if oldPod == nil {
+			notifyPodAdded(handlers, pod)
+		} else if !reflect.DeepEqual(oldPod, pod) {
+			notifyPodUpdated(handlers, oldPod, pod)
+		}
+	}
+	registry.pods = pods
+	glog.Infof("Registry file %s loaded, %d endpoints", registry.path, len(pods))
+	return nil
+}
+
+// WatchPods polls the file, an invalid file is ignored and the endpoints of the last valid one are kept.
+func (registry *FileRegistry) WatchPods(stopper chan struct{}, handlers ...PodEventHandler) {
+	wait.Until(func() {
+		if err := registry.sync(handlers); err != nil {
+			glog.Errorf("failed to load registry file %s, keep the current endpoints: %s", registry.path, err.Error())
+		}
+	}, FILE_REGISTRY_POLL_INTERVAL, stopper)
+}
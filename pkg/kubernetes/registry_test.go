@@ -0,0 +1,146 @@
+package kubernetes
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFileRegistryParse(t *testing.T) {
+	cases := []struct {
+		name string
+		data string
+		//expected weight of endpoint reviews-v1 if err is empty
+		weight uint32
+		err    string
+	}{
+		{
+			name: "default weight",
+			data: `
+services:
+- name: reviews
+  endpoints:
+  - name: reviews-v1
+    ip: 10.0.0.1
+`,
+			weight: DEFAULT_WEIGHT,
+		},
+		{
+			name: "weight field",
+			data: `
+services:
+- name: reviews
+  endpoints:
+  - name: reviews-v1
+    ip: 10.0.0.1
+    weight: 10
+`,
+			weight: 10,
+		},
+		{
+			name: "weight annotation",
+			data: `
+services:
+- name: reviews
+  endpoints:
+  - name: reviews-v1
+    ip: 10.0.0.1
+    annotations:
+      demo.envoy.weight: "20"
+`,
+			weight: 20,
+		},
+		{
+			name: "weight field above maximum",
+			data: `
+services:
+- name: reviews
+  endpoints:
+  - name: reviews-v1
+    ip: 10.0.0.1
+    weight: 1000
+`,
+			err: "weight 1000 is above",
+		},
+		{
+			name: "negative weight field",
+			data: `
+services:
+- name: reviews
+  endpoints:
+  - name: reviews-v1
+    ip: 10.0.0.1
+    weight: -1
+`,
+			err: "cannot unmarshal",
+		},
+		{
+			name: "invalid weight annotation",
+			data: `
+services:
+- name: reviews
+  endpoints:
+  - name: reviews-v1
+    ip: 10.0.0.1
+    annotations:
+      demo.envoy.weight: heavy
+`,
+			err: "is not an integer",
+		},
+		{
+			name: "invalid ip",
+			data: `
+services:
+- name: reviews
+  endpoints:
+  - name: reviews-v1
+    ip: 10.0.0.300
+`,
+			err: "invalid ip",
+		},
+		{
+			name: "missing ip",
+			data: `
+services:
+- name: reviews
+  endpoints:
+  - name: reviews-v1
+`,
+			err: "invalid ip",
+		},
+		{
+			name: "duplicate endpoint",
+			data: `
+services:
+- name: reviews
+  endpoints:
+  - name: reviews-v1
+    ip: 10.0.0.1
+  - name: reviews-v1
+    ip: 10.0.0.2
+`,
+			err: "duplicate endpoint name",
+		},
+	}
+	for _, c := range cases {
+		registry := NewFileRegistry(c.name)
+		pods, err := registry.parse([]byte(c.data))
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%s: expect error %q, got %v", c.name, c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", c.name, err.Error())
+			continue
+		}
+		pod := pods["reviews-v1"]
+		if pod == nil {
+			t.Errorf("%s: endpoint reviews-v1 not found", c.name)
+			continue
+		}
+		if pod.Weight() != c.weight {
+			t.Errorf("%s: expect weight %d, got %d", c.name, c.weight, pod.Weight())
+		}
+	}
+}
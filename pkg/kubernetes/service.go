@@ -0,0 +1,84 @@
+package kubernetes
+
+import (
+	"github.com/golang/glog"
+	"k8s.io/apimachinery/pkg/labels"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"reflect"
+	"sync"
+)
+
+type ServiceEventHandler interface {
+	// ServiceClusterIPsChanged is called with the cluster ip of every mesh app having one.
+	ServiceClusterIPsChanged(clusterIPs map[string]string)
+}
+
+// serviceClusterIPs reads the cluster ips of the mesh apps from the services cache.
+func serviceClusterIPs(lister corelisters.ServiceLister) map[string]string {
+	config := GetMeshConfig()
+	result := make(map[string]string)
+	services, err := lister.Services(config.AppNamespace).List(labels.Everything())
+	if err != nil {
+		glog.Errorf("failed to list cached services: %s", err.Error())
+		return result
+	}
+	for _, service := range services {
+		if _, ok := config.Apps[service.Name]; !ok {
+			continue
+		}
+		//headless services have no cluster ip
+		if service.Spec.ClusterIP != "" && service.Spec.ClusterIP != "None" {
+			result[service.Name] = service.Spec.ClusterIP
+		}
+	}
+	return result
+}
+
+// WatchServices keeps services in a shared informer cache, and notifies handlers whenever the cluster ips
+// of the mesh apps change, so that handlers never query the api server themselves.
+// A change of appNamespace is picked up on the next resync.
+func (manager *K8sResourceManager) WatchServices(stopper chan struct{}, handlers ...ServiceEventHandler) {
+	informer := manager.informerFactory.Core().V1().Services()
+	lister := informer.Lister()
+	synced := informer.Informer().HasSynced
+
+	var mutex sync.Mutex
+	var current map[string]string
+	update := func() {
+		//do not notify partial results while the initial list is still being added
+		if !synced() {
+			return
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		clusterIPs := serviceClusterIPs(lister)
+		if current != nil && reflect.DeepEqual(current, clusterIPs) {
+			return
+		}
+		current = clusterIPs
+		glog.Infof("service cluster ips changed: %v", clusterIPs)
+		for _, h := range handlers {
+			h.ServiceClusterIPsChanged(clusterIPs)
+		}
+	}
+	//objects are not inspected, so tombstones of missed deletes need no special care
+	informer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: func(obj interface{}) {
+			update()
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			update()
+		},
+		DeleteFunc: func(obj interface{}) {
+			update()
+		},
+	})
+	manager.informerFactory.Start(stopper)
+	if !cache.WaitForCacheSync(stopper, synced) {
+		glog.Errorf("failed to sync services cache")
+		return
+	}
+	update()
+	<-stopper
+}
@@ -0,0 +1,140 @@
+package kubernetes
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sort"
+	"strings"
+)
+
+const (
+	SERVICE_ENTRY_PLURAL = "serviceentries"
+	SERVICE_ENTRY_KIND   = "ServiceEntry"
+
+	RESOLUTION_DNS    = "DNS"
+	RESOLUTION_STATIC = "STATIC"
+)
+
+type ServiceEntryPort struct {
+	Number   uint32 `json:"number"`
+	Name     string `json:"name,omitempty"`
+	Protocol string `json:"protocol,omitempty"`
+}
+
+func (port *ServiceEntryPort) IsHTTP() bool {
+	switch strings.ToUpper(port.Protocol) {
+	case "", "HTTP", "HTTP2", "GRPC":
+		return true
+	}
+	return false
+}
+
+func (port *ServiceEntryPort) IsTLS() bool {
+	switch strings.ToUpper(port.Protocol) {
+	case "HTTPS", "TLS":
+		return true
+	}
+	return false
+}
+
+type ServiceEntryEndpoint struct {
+	Address string            `json:"address"`
+	Ports   map[string]uint32 `json:"ports,omitempty"`
+}
+
+type ServiceEntrySpec struct {
+	Hosts      []string               `json:"hosts"`
+	Ports      []ServiceEntryPort     `json:"ports"`
+	Resolution string                 `json:"resolution,omitempty"`
+	Endpoints  []ServiceEntryEndpoint `json:"endpoints,omitempty"`
+}
+
+type ServiceEntry struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              ServiceEntrySpec `json:"spec"`
+}
+
+type ServiceEntryList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []ServiceEntry `json:"items"`
+}
+
+type ServiceEntryInfo struct {
+	ResourceVersion string
+	Name            string
+	Namespace       string
+	Hosts           []string
+	Ports           []ServiceEntryPort
+	Resolution      string
+	Endpoints       []ServiceEntryEndpoint
+}
+
+// EndpointPort returns the port of endpoint for the given service entry port,
+// honouring the per-endpoint port overrides.
+func (entry *ServiceEntryInfo) EndpointPort(endpoint *ServiceEntryEndpoint, port *ServiceEntryPort) uint32 {
+	if endpoint.Ports != nil && endpoint.Ports[port.Name] != 0 {
+		return endpoint.Ports[port.Name]
+	}
+	return port.Number
+}
+
+func (entry *ServiceEntryInfo) String() string {
+	return fmt.Sprintf("ServiceEntry %s@%s hosts %s",
+		entry.Name, entry.Namespace, strings.Join(entry.Hosts, ","))
+}
+
+func NewServiceEntryInfo(entry *ServiceEntry) *ServiceEntryInfo {
+	resolution := strings.ToUpper(entry.Spec.Resolution)
+	if resolution == "" {
+		resolution = RESOLUTION_DNS
+	}
+	return &ServiceEntryInfo{
+		ResourceVersion: entry.ResourceVersion,
+		Name:            entry.Name,
+		Namespace:       entry.Namespace,
+		Hosts:           entry.Spec.Hosts,
+		Ports:           entry.Spec.Ports,
+		Resolution:      resolution,
+		Endpoints:       entry.Spec.Endpoints,
+	}
+}
+
+type ServiceEntryEventHandler interface {
+	ServiceEntriesChanged(entries []*ServiceEntryInfo)
+}
+
+func (manager *K8sResourceManager) WatchServiceEntries(stopper chan struct{}, handlers ...ServiceEntryEventHandler) {
+	var lastVersion string
+	wait.Until(func() {
+		var list ServiceEntryList
+		if err := manager.ListCustomResources(SERVICE_ENTRY_PLURAL, &list); err != nil {
+			glog.Errorf("failed to list service entries: %s", err.Error())
+			return
+		}
+		var entries []*ServiceEntryInfo
+		var versions []string
+		for i := range list.Items {
+			entry := NewServiceEntryInfo(&list.Items[i])
+			//entries created while the validating webhook was unavailable are checked again
+			if err := entry.Validate(); err != nil {
+				glog.Warningf("Ignore %s: %s", entry.String(), err.Error())
+				continue
+			}
+			entries = append(entries, entry)
+			versions = append(versions, entry.ResourceVersion)
+		}
+		sort.Strings(versions)
+		version := strings.Join(versions, ",")
+		if version == lastVersion {
+			return
+		}
+		lastVersion = version
+		for _, h := range handlers {
+			h.ServiceEntriesChanged(entries)
+		}
+	}, CRD_POLL_INTERVAL, stopper)
+}
@@ -0,0 +1,355 @@
+package kubernetes
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/ghodss/yaml"
+	"github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"os"
+	"strconv"
+	"sync"
+	"text/template"
+	"time"
+)
+
+const (
+	INJECTOR_CONFIGMAP    = "envoy-demo-injector"
+	INJECTOR_TEMPLATE_KEY = "template"
+
+	PROXY_IMAGE_ANNOTATION          = "demo.envoy.image"
+	PROXY_LOG_LEVEL_ANNOTATION      = "demo.envoy.logLevel"
+	PROXY_CPU_ANNOTATION            = "demo.envoy.cpu"
+	PROXY_MEMORY_ANNOTATION         = "demo.envoy.memory"
+	PROXY_CPU_LIMIT_ANNOTATION      = "demo.envoy.cpuLimit"
+	PROXY_MEMORY_LIMIT_ANNOTATION   = "demo.envoy.memoryLimit"
+	PROXY_VOLUMES_ANNOTATION        = "demo.envoy.volumes"
+	PROXY_VOLUME_MOUNTS_ANNOTATION  = "demo.envoy.volumeMounts"
+	PROXY_DRAIN_DURATION_ANNOTATION = "demo.envoy.drainDuration"
+	PROXY_HOLD_APP_ANNOTATION       = "demo.envoy.holdApplicationUntilProxyStarts"
+	DEFAULT_PROXY_LOG_LEVEL         = "info"
+	DEFAULT_CONTROL_PLANE_NAMESPACE = "default"
+)
+
+const DefaultSidecarTemplate = `
+containers:
+- name: envoy-proxy
+  image: {{ toJson .Values.Image }}
+  imagePullPolicy: Always
+  ports:
+  - name: grpc
+    containerPort: {{ .Values.ProxyPort }}
+  - name: manage
+    containerPort: {{ .Values.ManagePort }}
+  env:
+  - name: CONTROL_PLANE_PORT
+    value: "{{ .Values.ControlPlanePort }}"
+  - name: CONTROL_PLANE_SERVICE
+    value: {{ toJson .Values.ControlPlaneService }}
+  - name: PROXY_MANAGE_PORT
+    value: "{{ .Values.ManagePort }}"
+  - name: PROXY_PORT
+    value: "{{ .Values.ProxyPort }}"
+  - name: PROXY_UID
+    value: "{{ .Values.ProxyUID }}"
+  - name: ZIPKIN_SERVICE
+    value: {{ toJson .Mesh.Tracing.Service }}
+  - name: ZIPKIN_PORT
+    value: "{{ .Mesh.Tracing.Port }}"
+  - name: ZIPKIN_ENDPOINT
+    value: {{ toJson .Mesh.Tracing.CollectorEndpoint }}
+  - name: INBOUND_PORTS_INCLUDE
+    value: {{ toJson .Values.InboundPorts }}
+  - name: SERVICE_CLUSTER
+    value: {{ toJson .Pod.App }}
+  - name: LOG_LEVEL
+    value: {{ toJson .Values.LogLevel }}
+  - name: DISABLE_IPTABLES
+    value: "true"
+  - name: DRAIN_TIME_SECONDS
+    value: "{{ .Values.DrainSeconds }}"
+  - name: NODE_ID
+    valueFrom:
+      fieldRef:
+        fieldPath: metadata.name
+  resources: {{ toJson .Values.Resources }}
+  readinessProbe:
+    httpGet:
+      path: /ready
+      port: {{ .Values.ManagePort }}
+    periodSeconds: 2
+    failureThreshold: 30
+  lifecycle:
+{{- if .Values.HoldApplication }}
+    postStart:
+      exec:
+        command:
+        - sh
+        - -c
+        - for i in $(seq {{ .Values.ReadyTimeoutSeconds }}); do curl -fs http://127.0.0.1:{{ .Values.ManagePort }}/ready >/dev/null && exit 0; sleep 1; done; exit 1
+{{- end }}
+    preStop:
+      exec:
+        command:
+        - sh
+        - -c
+        - curl -fs -X POST http://127.0.0.1:{{ .Values.ManagePort }}/healthcheck/fail >/dev/null; sleep {{ .Values.DrainSeconds }}
+  volumeMounts: {{ toJson .Values.VolumeMounts }}
+  securityContext:
+    privileged: false
+    allowPrivilegeEscalation: false
+    runAsUser: {{ .Values.ProxyUID }}
+    runAsNonRoot: true
+    capabilities:
+      drop: ["ALL"]
+initContainers:
+- name: envoy-init
+  image: {{ toJson .Values.InitImage }}
+  imagePullPolicy: IfNotPresent
+  command: ["sh", "-c", {{ toJson .Values.IptablesScript }}]
+  securityContext:
+    privileged: false
+    allowPrivilegeEscalation: false
+    runAsUser: 0
+    runAsNonRoot: false
+    capabilities:
+      add: ["NET_ADMIN"]
+      drop: ["ALL"]
+volumes: {{ toJson .Values.Volumes }}
+`
+
+type SidecarValues struct {
+	Image               string
+	InitImage           string
+	LogLevel            string
+	InboundPorts        string
+	IptablesScript      string
+	ControlPlaneService string
+	ControlPlanePort    uint32
+	ManagePort          uint32
+	ProxyPort           uint32
+	ProxyUID            int64
+	HoldApplication     bool
+	ReadyTimeoutSeconds int64
+	DrainSeconds        int64
+	Resources           corev1.ResourceRequirements
+	Volumes             []corev1.Volume
+	VolumeMounts        []corev1.VolumeMount
+}
+
+type SidecarTemplateData struct {
+	Pod    *PodInfo
+	Spec   *corev1.PodSpec
+	Mesh   *MeshConfig
+	Values *SidecarValues
+}
+
+type Sidecar struct {
+	Containers     []corev1.Container `json:"containers"`
+	InitContainers []corev1.Container `json:"initContainers"`
+	Volumes        []corev1.Volume    `json:"volumes"`
+}
+
+func parseSidecarTemplate(text string) (*template.Template, error) {
+	return template.New("sidecar").Funcs(template.FuncMap{
+		"toJson": func(value interface{}) (string, error) {
+			data, err := json.Marshal(value)
+			return string(data), err
+		},
+	}).Parse(text)
+}
+
+func ControlPlaneNamespace() string {
+	if namespace := os.Getenv("POD_NAMESPACE"); namespace != "" {
+		return namespace
+	}
+	return DEFAULT_CONTROL_PLANE_NAMESPACE
+}
+
+// NewSidecarValues returns the template values of pod, annotations of the pod override the defaults.
+func NewSidecarValues(pod *PodInfo, inboundPorts string) (*SidecarValues, error) {
+	config := GetMeshConfig()
+	lifecycle := config.Lifecycle
+	values := &SidecarValues{
+		Image:               os.Getenv("ENVOY_IMAGE"),
+		InitImage:           os.Getenv("ENVOY_INIT_IMAGE"),
+		LogLevel:            DEFAULT_PROXY_LOG_LEVEL,
+		InboundPorts:        inboundPorts,
+		IptablesScript:      iptablesScript(inboundPorts),
+		ControlPlaneService: config.ControlPlane.Service,
+		ControlPlanePort:    config.ControlPlane.Port,
+		ManagePort:          config.Proxy.ManagePort,
+		ProxyPort:           config.Proxy.ListenPort,
+		ProxyUID:            config.Proxy.UID,
+		HoldApplication:     lifecycle.HoldApplicationUntilProxyStarts,
+		ReadyTimeoutSeconds: int64(lifecycle.ProxyReadyTimeout.Seconds()),
+		DrainSeconds:        int64(lifecycle.DrainDuration.Seconds()),
+		Resources: corev1.ResourceRequirements{
+			Requests: corev1.ResourceList{},
+			Limits:   corev1.ResourceList{},
+		},
+	}
+	if values.InitImage == "" {
+		values.InitImage = values.Image
+	}
+	if image := pod.Annotations[PROXY_IMAGE_ANNOTATION]; image != "" {
+		values.Image = image
+	}
+	if logLevel := pod.Annotations[PROXY_LOG_LEVEL_ANNOTATION]; logLevel != "" {
+		values.LogLevel = logLevel
+	}
+	for annotation, target := range map[string]corev1.ResourceList{
+		PROXY_CPU_ANNOTATION:          values.Resources.Requests,
+		PROXY_MEMORY_ANNOTATION:       values.Resources.Requests,
+		PROXY_CPU_LIMIT_ANNOTATION:    values.Resources.Limits,
+		PROXY_MEMORY_LIMIT_ANNOTATION: values.Resources.Limits,
+	} {
+		value := pod.Annotations[annotation]
+		if value == "" {
+			continue
+		}
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid annotation %s=%s: %s", annotation, value, err.Error())
+		}
+		name := corev1.ResourceCPU
+		if annotation == PROXY_MEMORY_ANNOTATION || annotation == PROXY_MEMORY_LIMIT_ANNOTATION {
+			name = corev1.ResourceMemory
+		}
+		target[name] = quantity
+	}
+	if value := pod.Annotations[PROXY_DRAIN_DURATION_ANNOTATION]; value != "" {
+		drain, err := time.ParseDuration(value)
+		if err != nil || drain < 0 {
+			return nil, fmt.Errorf("invalid annotation %s=%s", PROXY_DRAIN_DURATION_ANNOTATION, value)
+		}
+		values.DrainSeconds = int64(drain.Seconds())
+	}
+	if value := pod.Annotations[PROXY_HOLD_APP_ANNOTATION]; value != "" {
+		hold, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid annotation %s=%s", PROXY_HOLD_APP_ANNOTATION, value)
+		}
+		values.HoldApplication = hold
+	}
+	if value := pod.Annotations[PROXY_VOLUMES_ANNOTATION]; value != "" {
+		if err := json.Unmarshal([]byte(value), &values.Volumes); err != nil {
+			return nil, fmt.Errorf("invalid annotation %s: %s", PROXY_VOLUMES_ANNOTATION, err.Error())
+		}
+	}
+	if value := pod.Annotations[PROXY_VOLUME_MOUNTS_ANNOTATION]; value != "" {
+		if err := json.Unmarshal([]byte(value), &values.VolumeMounts); err != nil {
+			return nil, fmt.Errorf("invalid annotation %s: %s", PROXY_VOLUME_MOUNTS_ANNOTATION, err.Error())
+		}
+	}
+	return values, nil
+}
+
+// SidecarTemplate renders the injected containers and volumes from a text template,
+// which is reloaded from the envoy-demo-injector ConfigMap.
+type SidecarTemplate struct {
+	mutex    sync.RWMutex
+	template *template.Template
+	version  string
+}
+
+func NewSidecarTemplate() *SidecarTemplate {
+	tmpl, err := parseSidecarTemplate(DefaultSidecarTemplate)
+	if err != nil {
+		panic(err.Error())
+	}
+	return &SidecarTemplate{template: tmpl}
+}
+
+func (sidecar *SidecarTemplate) Render(data *SidecarTemplateData) (*Sidecar, error) {
+	sidecar.mutex.RLock()
+	tmpl := sidecar.template
+	sidecar.mutex.RUnlock()
+
+	return renderSidecar(tmpl, data)
+}
+
+func renderSidecar(tmpl *template.Template, data *SidecarTemplateData) (*Sidecar, error) {
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return nil, err
+	}
+	result := &Sidecar{}
+	if err := yaml.Unmarshal(buf.Bytes(), result); err != nil {
+		return nil, fmt.Errorf("invalid rendered sidecar: %s", err.Error())
+	}
+	return result, nil
+}
+
+func (sidecar *SidecarTemplate) update(text string, version string) error {
+	sidecar.mutex.Lock()
+	defer sidecar.mutex.Unlock()
+
+	if version == sidecar.version {
+		return nil
+	}
+	tmpl, err := parseSidecarTemplate(text)
+	if err != nil {
+		return err
+	}
+	//templates which only fail at execution are kept out as well
+	if err := trialRender(tmpl); err != nil {
+		return fmt.Errorf("sidecar template version %s: %s", version, err.Error())
+	}
+	sidecar.template = tmpl
+	sidecar.version = version
+	glog.Infof("Sidecar template updated, version=%s", version)
+	return nil
+}
+
+// trialRender renders tmpl for a sample pod without annotations.
+func trialRender(tmpl *template.Template) error {
+	pod := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "sample",
+			Namespace: ControlPlaneNamespace(),
+			Labels:    map[string]string{"app": "sample"},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{
+				Name:  "sample",
+				Ports: []corev1.ContainerPort{{ContainerPort: 8080}},
+			}},
+		},
+	}
+	podInfo := NewPodInfo(pod)
+	values, err := NewSidecarValues(podInfo, "8080")
+	if err != nil {
+		return err
+	}
+	_, err = renderSidecar(tmpl, &SidecarTemplateData{
+		Pod:    podInfo,
+		Spec:   &pod.Spec,
+		Mesh:   GetMeshConfig(),
+		Values: values,
+	})
+	return err
+}
+
+func (sidecar *SidecarTemplate) Watch(stopper chan struct{}, k8sManager *K8sResourceManager) {
+	wait.Until(func() {
+		configMap, err := k8sManager.GetConfigMap(ControlPlaneNamespace(), INJECTOR_CONFIGMAP)
+		if err != nil {
+			if apierrors.IsNotFound(err) {
+				err = sidecar.update(DefaultSidecarTemplate, "")
+			}
+		} else if text := configMap.Data[INJECTOR_TEMPLATE_KEY]; text != "" {
+			err = sidecar.update(text, configMap.ResourceVersion)
+		} else {
+			err = sidecar.update(DefaultSidecarTemplate, "")
+		}
+		if err != nil {
+			glog.Errorf("failed to load sidecar template: %s", err.Error())
+		}
+	}, CRD_POLL_INTERVAL, stopper)
+}
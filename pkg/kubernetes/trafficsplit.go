@@ -0,0 +1,169 @@
+package kubernetes
+
+import (
+	"fmt"
+	"github.com/golang/glog"
+	"k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sort"
+	"strings"
+)
+
+const (
+	TRAFFIC_SPLIT_PLURAL = "trafficsplits"
+	TRAFFIC_SPLIT_KIND   = "TrafficSplit"
+	TRAFFIC_SPLIT_TOTAL  = 100
+)
+
+type TrafficSplitBackend struct {
+	Version string `json:"version"`
+	Weight  uint32 `json:"weight"`
+}
+
+type TrafficSplitSpec struct {
+	Service  string                `json:"service"`
+	Backends []TrafficSplitBackend `json:"backends"`
+}
+
+type TrafficSplit struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+	Spec              TrafficSplitSpec `json:"spec"`
+}
+
+type TrafficSplitList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+	Items           []TrafficSplit `json:"items"`
+}
+
+type TrafficSplitInfo struct {
+	ResourceVersion string
+	Name            string
+	Namespace       string
+	UID             types.UID
+	Service         string
+	Backends        []TrafficSplitBackend
+}
+
+func (split *TrafficSplitInfo) String() string {
+	var backends []string
+	for _, backend := range split.Backends {
+		backends = append(backends, fmt.Sprintf("%s=%d", backend.Version, backend.Weight))
+	}
+	return fmt.Sprintf("TrafficSplit %s@%s service %s %s",
+		split.Name, split.Namespace, split.Service, strings.Join(backends, ","))
+}
+
+// Key identifies the split service, services of the same name in different namespaces are different.
+func (split *TrafficSplitInfo) Key() string {
+	return fmt.Sprintf("%s/%s", split.Namespace, split.Service)
+}
+
+func (split *TrafficSplitInfo) Validate() error {
+	if split.Service == "" {
+		return fmt.Errorf("service is empty")
+	}
+	//mesh apps are only known in the app namespace
+	if appNamespace := GetMeshConfig().AppNamespace; split.Namespace != appNamespace {
+		return fmt.Errorf("service %s is not in the app namespace %s", split.Key(), appNamespace)
+	}
+	if AppPort(split.Service) == 0 {
+		return fmt.Errorf("unknown service %s", split.Service)
+	}
+	if len(split.Backends) == 0 {
+		return fmt.Errorf("no backends defined")
+	}
+	var total uint32
+	versions := make(map[string]bool)
+	for _, backend := range split.Backends {
+		if backend.Version == "" {
+			return fmt.Errorf("backend version is empty")
+		}
+		if versions[backend.Version] {
+			return fmt.Errorf("duplicated backend version %s", backend.Version)
+		}
+		versions[backend.Version] = true
+		total += backend.Weight
+	}
+	if total != TRAFFIC_SPLIT_TOTAL {
+		return fmt.Errorf("backend weights sum to %d, expect %d", total, TRAFFIC_SPLIT_TOTAL)
+	}
+	return nil
+}
+
+func NewTrafficSplitInfo(split *TrafficSplit) *TrafficSplitInfo {
+	return &TrafficSplitInfo{
+		ResourceVersion: split.ResourceVersion,
+		Name:            split.Name,
+		Namespace:       split.Namespace,
+		UID:             split.UID,
+		Service:         split.Spec.Service,
+		Backends:        split.Spec.Backends,
+	}
+}
+
+type TrafficSplitEventHandler interface {
+	TrafficSplitsChanged(splits []*TrafficSplitInfo)
+}
+
+func (manager *K8sResourceManager) recordTrafficSplitWarning(split *TrafficSplitInfo, reason string, message string) {
+	glog.Warningf("%s: %s", split.String(), message)
+	err := manager.RecordEvent(&v1.ObjectReference{
+		APIVersion:      fmt.Sprintf("%s/%s", CRD_GROUP, CRD_VERSION),
+		Kind:            TRAFFIC_SPLIT_KIND,
+		Name:            split.Name,
+		Namespace:       split.Namespace,
+		UID:             split.UID,
+		ResourceVersion: split.ResourceVersion,
+	}, v1.EventTypeWarning, reason, message)
+	if err != nil {
+		glog.Errorf("failed to record event for %s: %s", split.String(), err.Error())
+	}
+}
+
+func (manager *K8sResourceManager) WatchTrafficSplits(stopper chan struct{}, handlers ...TrafficSplitEventHandler) {
+	var lastVersion string
+	wait.Until(func() {
+		var list TrafficSplitList
+		if err := manager.ListCustomResources(TRAFFIC_SPLIT_PLURAL, &list); err != nil {
+			glog.Errorf("failed to list traffic splits: %s", err.Error())
+			return
+		}
+		var versions []string
+		for _, split := range list.Items {
+			versions = append(versions, split.ResourceVersion)
+		}
+		sort.Strings(versions)
+		version := strings.Join(versions, ",")
+		if version == lastVersion {
+			return
+		}
+		lastVersion = version
+
+		sort.Slice(list.Items, func(i, j int) bool {
+			return list.Items[i].CreationTimestamp.Before(&list.Items[j].CreationTimestamp)
+		})
+		var splits []*TrafficSplitInfo
+		services := make(map[string]string)
+		for i := range list.Items {
+			split := NewTrafficSplitInfo(&list.Items[i])
+			if err := split.Validate(); err != nil {
+				manager.recordTrafficSplitWarning(split, "InvalidTrafficSplit", err.Error())
+				continue
+			}
+			if existing := services[split.Key()]; existing != "" {
+				manager.recordTrafficSplitWarning(split, "ConflictingTrafficSplit",
+					fmt.Sprintf("service %s is already split by %s", split.Key(), existing))
+				continue
+			}
+			services[split.Key()] = split.Name
+			splits = append(splits, split)
+		}
+		for _, h := range handlers {
+			h.TrafficSplitsChanged(splits)
+		}
+	}, CRD_POLL_INTERVAL, stopper)
+}
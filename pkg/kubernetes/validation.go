@@ -0,0 +1,154 @@
+package kubernetes
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var proxyLogLevels = map[string]bool{
+	"trace": true, "debug": true, "info": true, "warning": true, "warn": true,
+	"error": true, "critical": true, "off": true,
+}
+
+// ParseWeight parses the value of the endpoint weight annotation, which must be an integer in [0, MAX_WEIGHT].
+func ParseWeight(value string) (uint32, error) {
+	i, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("%s=%q is not an integer", ENDPOINT_WEIGHT_ANNOTATION, value)
+	}
+	if i < 0 || i > MAX_WEIGHT {
+		return 0, fmt.Errorf("%s=%q is out of range [0, %d]", ENDPOINT_WEIGHT_ANNOTATION, value, MAX_WEIGHT)
+	}
+	return uint32(i), nil
+}
+
+// ValidateAnnotation checks the value of a single mesh annotation, unknown keys are accepted.
+func ValidateAnnotation(key string, value string) error {
+	switch key {
+	case ENDPOINT_WEIGHT_ANNOTATION:
+		_, err := ParseWeight(value)
+		return err
+	case ENVOY_ENABLE_ANNOTATION, ENDPOINT_DRAIN_ANNOTATION:
+		if !strings.EqualFold(value, "true") && !strings.EqualFold(value, "false") {
+			return fmt.Errorf("%s=%q must be true or false", key, value)
+		}
+	case PROXY_LOG_LEVEL_ANNOTATION:
+		if !proxyLogLevels[value] {
+			return fmt.Errorf("%s=%q is not an envoy log level", key, value)
+		}
+	case PROXY_CPU_ANNOTATION, PROXY_MEMORY_ANNOTATION, PROXY_CPU_LIMIT_ANNOTATION, PROXY_MEMORY_LIMIT_ANNOTATION,
+		PROXY_VOLUMES_ANNOTATION, PROXY_VOLUME_MOUNTS_ANNOTATION, PROXY_DRAIN_DURATION_ANNOTATION, PROXY_HOLD_APP_ANNOTATION:
+		_, err := NewSidecarValues(&PodInfo{Annotations: map[string]string{key: value}}, "")
+		return err
+	}
+	return nil
+}
+
+// ValidateAnnotations returns the errors of mesh annotations which differ from oldAnnotations,
+// so that updates of pods created before validation was enabled are not blocked.
+func ValidateAnnotations(annotations map[string]string, oldAnnotations map[string]string) []string {
+	var result []string
+	for key, value := range annotations {
+		if old, ok := oldAnnotations[key]; ok && old == value {
+			continue
+		}
+		if err := ValidateAnnotation(key, value); err != nil {
+			result = append(result, err.Error())
+		}
+	}
+	return result
+}
+
+func (entry *ServiceEntryInfo) Validate() error {
+	if len(entry.Hosts) == 0 {
+		return fmt.Errorf("no hosts defined")
+	}
+	config := GetMeshConfig()
+	for _, host := range entry.Hosts {
+		if host == "" {
+			return fmt.Errorf("host is empty")
+		}
+		//the cluster and virtual host of the entry would replace the ones of the app
+		for app := range config.Apps {
+			if host == app || host == fmt.Sprintf("%s.%s", app, config.AppNamespace) {
+				return fmt.Errorf("host %s is the mesh app %s", host, app)
+			}
+		}
+	}
+	if len(entry.Ports) == 0 {
+		return fmt.Errorf("no ports defined")
+	}
+	for _, port := range entry.Ports {
+		if port.Number == 0 || port.Number > 65535 {
+			return fmt.Errorf("invalid port number %d", port.Number)
+		}
+		switch strings.ToUpper(port.Protocol) {
+		case "", "HTTP", "HTTP2", "GRPC", "HTTPS", "TLS", "TCP":
+		default:
+			return fmt.Errorf("unknown protocol %s of port %d", port.Protocol, port.Number)
+		}
+	}
+	switch entry.Resolution {
+	case RESOLUTION_DNS:
+	case RESOLUTION_STATIC:
+		if len(entry.Endpoints) == 0 {
+			return fmt.Errorf("resolution %s requires endpoints", RESOLUTION_STATIC)
+		}
+		for _, endpoint := range entry.Endpoints {
+			if net.ParseIP(endpoint.Address) == nil {
+				return fmt.Errorf("endpoint address %s is not an ip with resolution %s", endpoint.Address, RESOLUTION_STATIC)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown resolution %s, expect %s or %s", entry.Resolution, RESOLUTION_DNS, RESOLUTION_STATIC)
+	}
+	return nil
+}
+
+func (canary *Canary) Validate() error {
+	spec := &canary.Spec
+	if spec.App == "" {
+		return fmt.Errorf("app is empty")
+	}
+	if AppPort(spec.App) == 0 {
+		return fmt.Errorf("unknown app %s", spec.App)
+	}
+	if spec.StableVersion == "" || spec.CanaryVersion == "" {
+		return fmt.Errorf("stableVersion and canaryVersion are required")
+	}
+	if spec.StableVersion == spec.CanaryVersion {
+		return fmt.Errorf("stableVersion and canaryVersion are both %s", spec.StableVersion)
+	}
+	if len(spec.Steps) == 0 {
+		return fmt.Errorf("no steps defined")
+	}
+	for _, step := range spec.Steps {
+		if step > 100 {
+			return fmt.Errorf("step weight %d is above 100", step)
+		}
+	}
+	if spec.StepInterval != "" {
+		if _, err := time.ParseDuration(spec.StepInterval); err != nil {
+			return fmt.Errorf("invalid stepInterval %s: %s", spec.StepInterval, err.Error())
+		}
+	}
+	if spec.StepTimeout != "" {
+		timeout, err := time.ParseDuration(spec.StepTimeout)
+		if err != nil {
+			return fmt.Errorf("invalid stepTimeout %s: %s", spec.StepTimeout, err.Error())
+		}
+		if timeout <= canary.stepInterval() {
+			return fmt.Errorf("stepTimeout %s must be longer than stepInterval", spec.StepTimeout)
+		}
+	}
+	if spec.Thresholds.MinSuccessRate < 0 || spec.Thresholds.MinSuccessRate > 100 {
+		return fmt.Errorf("minSuccessRate %.2f is out of range [0, 100]", spec.Thresholds.MinSuccessRate)
+	}
+	if spec.Thresholds.MaxLatencyMs < 0 {
+		return fmt.Errorf("maxLatencyMs %.2f is negative", spec.Thresholds.MaxLatencyMs)
+	}
+	return nil
+}
@@ -12,7 +12,21 @@ import (
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
 	"net/http"
-	"os"
+	"sort"
+	"strings"
+)
+
+const (
+	PROXY_CONTAINER_NAME      = "envoy-proxy"
+	INIT_CONTAINER_NAME       = "envoy-init"
+	ENVOY_INJECTED_ANNOTATION = "demo.envoy.injected"
+	//kubectl logs/exec target the application instead of envoy-proxy when it is the first container
+	DEFAULT_CONTAINER_ANNOTATION     = "kubectl.kubernetes.io/default-container"
+	DEFAULT_TERMINATION_GRACE_PERIOD = 30
+	TERMINATION_GRACE_MARGIN         = 5
+	ADMISSION_REVIEW_V1              = "admission.k8s.io/v1"
+	ADMISSION_REVIEW_V1BETA1         = "admission.k8s.io/v1beta1"
+	ADMISSION_REVIEW_KIND            = "AdmissionReview"
 )
 
 var (
@@ -22,20 +36,23 @@ var (
 )
 
 type WebhookServer struct {
-	server *http.Server
+	server          *http.Server
+	k8sManager      *K8sResourceManager
+	sidecarTemplate *SidecarTemplate
+	certManager     *WebhookCertManager
 }
 
-func NewWebhookServer() *WebhookServer {
-	pair, err := tls.LoadX509KeyPair("/etc/webhook/certs/cert.crt", "/etc/webhook/certs/cert.key")
-	if err != nil {
-		panic(err.Error())
-	}
+func NewWebhookServer(k8sManager *K8sResourceManager) *WebhookServer {
+	certManager := NewWebhookCertManager(k8sManager)
 
 	server := &WebhookServer{
 		server: &http.Server{
 			Addr:      ":443",
-			TLSConfig: &tls.Config{Certificates: []tls.Certificate{pair}},
+			TLSConfig: &tls.Config{GetCertificate: certManager.GetCertificate},
 		},
+		k8sManager:      k8sManager,
+		sidecarTemplate: NewSidecarTemplate(),
+		certManager:     certManager,
 	}
 
 	return server
@@ -47,6 +64,30 @@ type patchOperation struct {
 	Value interface{} `json:"value,omitempty"`
 }
 
+// skipInjection admits pod without the sidecar, a broken template or annotation should not block
+// pod creation. The pod runs outside of the mesh, which is reported by a warning event.
+func (server *WebhookServer) skipInjection(pod *corev1.Pod, reason string, cause error) *v1beta1.AdmissionResponse {
+	name := pod.Name
+	if name == "" {
+		//event names are generated from the name, a trailing '-' would make them invalid
+		name = strings.TrimSuffix(pod.GenerateName, "-")
+	}
+	message := fmt.Sprintf("envoy sidecar not injected: %s", cause.Error())
+	glog.Warningf("%s@%s: %s", name, pod.Namespace, message)
+	//the pod does not exist yet, the event is matched by name only
+	err := server.k8sManager.RecordEvent(&corev1.ObjectReference{
+		Kind:      "Pod",
+		Name:      name,
+		Namespace: pod.Namespace,
+	}, corev1.EventTypeWarning, reason, message)
+	if err != nil {
+		glog.Errorf("failed to record event for %s@%s: %s", name, pod.Namespace, err.Error())
+	}
+	return &v1beta1.AdmissionResponse{
+		Allowed: true,
+	}
+}
+
 func (server *WebhookServer) Mutate(ar *v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
 	req := ar.Request
 
@@ -64,69 +105,94 @@ func (server *WebhookServer) Mutate(ar *v1beta1.AdmissionReview) *v1beta1.Admiss
 			},
 		}
 	}
+	if pod.Namespace == "" {
+		pod.Namespace = req.Namespace
+	}
 	podInfo := NewPodInfo(&pod)
-	port := DemoAppSet[podInfo.App()]
-	if port == 0 {
+	if injected := alreadyInjected(&pod); injected != "" {
+		//reinvoked webhook or pod created from an injected spec
+		glog.Infof("Skip %s@%s: %s", pod.GenerateName, pod.Namespace, injected)
 		return &v1beta1.AdmissionResponse{
 			Allowed: true,
 		}
 	}
-	var ports []string
-	for _, container := range pod.Spec.Containers {
-		for _, port := range container.Ports {
-			ports = append(ports, fmt.Sprintf("%d", port.ContainerPort))
-		}
-	}
-	envMap := map[string]string{
-		"CONTROL_PLANE_PORT":    fmt.Sprintf("%d", CONTROL_PLANE_PORT),
-		"CONTROL_PLANE_SERVICE": CONTROL_PLANE_SERVICE,
-		"PROXY_MANAGE_PORT":     fmt.Sprintf("%d", MANAGE_PORT),
-		"PROXY_PORT":            fmt.Sprintf("%d", ENVOY_LISTEN_PORT),
-		"PROXY_UID":             fmt.Sprintf("%d", PROXY_UID),
-		"ZIPKIN_SERVICE":        ZIPKIN_SERVICE,
-		"ZIPKIN_PORT":           fmt.Sprintf("%d", ZIPKIN_PORT),
-		"INBOUND_PORTS_INCLUDE": fmt.Sprintf("%d", APP_PORT),
-		"SERVICE_CLUSTER":       podInfo.App(),
-	}
-
-	var container corev1.Container
-	container.Name = "envoy-proxy"
-	container.ImagePullPolicy = corev1.PullAlways
-	container.Image = os.Getenv("ENVOY_IMAGE")
-	container.Ports = append(container.Ports, corev1.ContainerPort{
-		Name:          "grpc",
-		ContainerPort: ENVOY_LISTEN_PORT,
-	})
-	container.Ports = append(container.Ports, corev1.ContainerPort{
-		Name:          "manage",
-		ContainerPort: MANAGE_PORT,
-	})
-	for k, v := range envMap {
-		container.Env = append(container.Env, corev1.EnvVar{
-			Name:  k,
-			Value: v,
-		})
+	decision := server.decideInjection(podInfo)
+	glog.Infof("Inject %s@%s: %v, %s", pod.GenerateName, pod.Namespace, decision.Inject, decision.Reason)
+	if !decision.Inject {
+		return &v1beta1.AdmissionResponse{
+			Allowed: true,
+		}
 	}
-	privileged := true
-	container.SecurityContext = &corev1.SecurityContext{
-		Privileged: &privileged,
+	//inbound listeners are only built for the port of mesh apps, inbound traffic to other pods would end
+	//at the virtual listener, so only their outbound traffic goes through envoy
+	var inboundPorts string
+	if port := AppPort(podInfo.App()); port != 0 {
+		inboundPorts = fmt.Sprintf("%d", port)
 	}
-	container.Env = append(container.Env, corev1.EnvVar{
-		Name: "NODE_ID",
-		ValueFrom: &corev1.EnvVarSource{
-			FieldRef: &corev1.ObjectFieldSelector{
-				FieldPath: "metadata.name",
-			},
-		},
+	values, err := NewSidecarValues(podInfo, inboundPorts)
+	if err != nil {
+		return server.skipInjection(&pod, "InvalidSidecarValues", err)
+	}
+	sidecar, err := server.sidecarTemplate.Render(&SidecarTemplateData{
+		Pod:    podInfo,
+		Spec:   &pod.Spec,
+		Mesh:   GetMeshConfig(),
+		Values: values,
 	})
+	if err != nil {
+		return server.skipInjection(&pod, "SidecarRenderFailed", err)
+	}
 
-	containers := pod.Spec.Containers
-	containers = append(containers, container)
-	patch := []patchOperation{{
-		Op:    "add",
-		Path:  "/spec/containers",
-		Value: containers,
-	}}
+	var patch []patchOperation
+	annotations := map[string]string{ENVOY_INJECTED_ANNOTATION: "true"}
+	if values.HoldApplication && len(pod.Spec.Containers) > 0 {
+		//containers start in order and postStart of envoy-proxy blocks until it is ready
+		for i, container := range sidecar.Containers {
+			patch = append(patch, patchOperation{
+				Op:    "add",
+				Path:  fmt.Sprintf("/spec/containers/%d", i),
+				Value: container,
+			})
+		}
+		annotations[DEFAULT_CONTAINER_ANNOTATION] = pod.Spec.Containers[0].Name
+	} else {
+		for i, container := range sidecar.Containers {
+			patch = append(patch, addElementPatch("/spec/containers", len(pod.Spec.Containers)+i, container))
+		}
+	}
+	//the pod must outlive the drain of envoy-proxy
+	gracePeriod := int64(DEFAULT_TERMINATION_GRACE_PERIOD)
+	if pod.Spec.TerminationGracePeriodSeconds != nil {
+		gracePeriod = *pod.Spec.TerminationGracePeriodSeconds
+	}
+	if minimum := values.DrainSeconds + TERMINATION_GRACE_MARGIN; gracePeriod < minimum {
+		patch = append(patch, patchOperation{
+			Op:    "add",
+			Path:  "/spec/terminationGracePeriodSeconds",
+			Value: minimum,
+		})
+	}
+	for i, container := range sidecar.InitContainers {
+		patch = append(patch, addElementPatch("/spec/initContainers", len(pod.Spec.InitContainers)+i, container))
+	}
+	for i, volume := range sidecar.Volumes {
+		patch = append(patch, addElementPatch("/spec/volumes", len(pod.Spec.Volumes)+i, volume))
+	}
+	if pod.Annotations == nil {
+		patch = append(patch, patchOperation{
+			Op:    "add",
+			Path:  "/metadata/annotations",
+			Value: annotations,
+		})
+	} else {
+		for key, value := range annotations {
+			patch = append(patch, patchOperation{
+				Op:    "add",
+				Path:  "/metadata/annotations/" + escapeJsonPointer(key),
+				Value: value,
+			})
+		}
+	}
 
 	patchBytes, err := json.Marshal(patch)
 	if err != nil {
@@ -148,62 +214,252 @@ func (server *WebhookServer) Mutate(ar *v1beta1.AdmissionReview) *v1beta1.Admiss
 	}
 }
 
-func (server *WebhookServer) Process(resp http.ResponseWriter, req *http.Request) {
-	var body []byte
-	if req.Body != nil {
-		if data, err := ioutil.ReadAll(req.Body); err == nil {
-			body = data
+// addElementPatch appends value to the array at path, creating the array if it is empty.
+func addElementPatch(path string, size int, value interface{}) patchOperation {
+	if size == 0 {
+		return patchOperation{
+			Op:    "add",
+			Path:  path,
+			Value: []interface{}{value},
 		}
 	}
-	if len(body) == 0 {
-		http.Error(resp, "empty body", http.StatusBadRequest)
-		return
+	return patchOperation{
+		Op:    "add",
+		Path:  path + "/-",
+		Value: value,
 	}
+}
 
-	// verify the content type is accurate
-	contentType := req.Header.Get("Content-Type")
-	if contentType != "application/json" {
-		glog.Errorf("Content-Type=%s, expect application/json", contentType)
-		http.Error(resp, "invalid Content-Type, expect `application/json`", http.StatusUnsupportedMediaType)
-		return
+func escapeJsonPointer(key string) string {
+	return strings.Replace(strings.Replace(key, "~", "~0", -1), "/", "~1", -1)
+}
+
+func alreadyInjected(pod *corev1.Pod) string {
+	if _, ok := pod.Annotations[ENVOY_INJECTED_ANNOTATION]; ok {
+		return fmt.Sprintf("annotation %s exists", ENVOY_INJECTED_ANNOTATION)
 	}
+	for _, container := range pod.Spec.Containers {
+		if container.Name == PROXY_CONTAINER_NAME {
+			return fmt.Sprintf("container %s exists", PROXY_CONTAINER_NAME)
+		}
+	}
+	for _, container := range pod.Spec.InitContainers {
+		if container.Name == INIT_CONTAINER_NAME {
+			return fmt.Sprintf("init container %s exists", INIT_CONTAINER_NAME)
+		}
+	}
+	return ""
+}
 
-	var admissionResponse *v1beta1.AdmissionResponse
-	ar := v1beta1.AdmissionReview{}
-	if _, _, err := deserializer.Decode(body, nil, &ar); err != nil {
-		glog.Errorf("Can't decode body: %v", err)
-		admissionResponse = &v1beta1.AdmissionResponse{
-			Result: &metav1.Status{
-				Message: err.Error(),
-			},
+// iptablesScript redirects inbound traffic of inboundPorts and all outbound traffic
+// except the one of envoy itself to the envoy listen port.
+func iptablesScript(inboundPorts string) string {
+	proxy := GetMeshConfig().Proxy
+	rules := []string{
+		"set -e",
+		"iptables -t nat -N ENVOY_REDIRECT",
+		fmt.Sprintf("iptables -t nat -A ENVOY_REDIRECT -p tcp -j REDIRECT --to-port %d", proxy.ListenPort),
+		"iptables -t nat -N ENVOY_INBOUND",
+		"iptables -t nat -A PREROUTING -p tcp -j ENVOY_INBOUND",
+	}
+	for _, port := range strings.Split(inboundPorts, ",") {
+		if port == "" {
+			continue
 		}
-	} else {
-		admissionResponse = server.Mutate(&ar)
+		rules = append(rules, fmt.Sprintf("iptables -t nat -A ENVOY_INBOUND -p tcp --dport %s -j ENVOY_REDIRECT", port))
 	}
+	rules = append(rules,
+		"iptables -t nat -N ENVOY_OUTPUT",
+		"iptables -t nat -A OUTPUT -p tcp -j ENVOY_OUTPUT",
+		fmt.Sprintf("iptables -t nat -A ENVOY_OUTPUT -m owner --uid-owner %d -j RETURN", proxy.UID),
+		"iptables -t nat -A ENVOY_OUTPUT -d 127.0.0.1/32 -j RETURN",
+		"iptables -t nat -A ENVOY_OUTPUT -j ENVOY_REDIRECT",
+	)
+	return strings.Join(rules, "\n")
+}
 
-	admissionReview := v1beta1.AdmissionReview{}
-	if admissionResponse != nil {
-		admissionReview.Response = admissionResponse
-		if ar.Request != nil {
-			admissionReview.Response.UID = ar.Request.UID
+func (server *WebhookServer) decideInjection(podInfo *PodInfo) *InjectionDecision {
+	var namespaceLabels map[string]string
+	if podInfo.Namespace != "" {
+		var err error
+		namespaceLabels, err = server.k8sManager.GetNamespaceLabels(podInfo.Namespace)
+		if err != nil {
+			glog.Errorf("failed to get labels of namespace %s: %s", podInfo.Namespace, err.Error())
 		}
 	}
+	return DecideInjection(podInfo, namespaceLabels, &GetMeshConfig().Injection)
+}
 
-	result, err := json.Marshal(admissionReview)
-	if err != nil {
-		glog.Errorf("Can't encode response: %v", err)
-		http.Error(resp, fmt.Sprintf("could not encode response: %v", err), http.StatusInternalServerError)
+// Explain answers whether the posted pod would be injected and why, without changing anything.
+func (server *WebhookServer) Explain(resp http.ResponseWriter, req *http.Request) {
+	var pod corev1.Pod
+	if err := json.NewDecoder(req.Body).Decode(&pod); err != nil {
+		http.Error(resp, fmt.Sprintf("could not decode pod: %v", err), http.StatusBadRequest)
+		return
+	}
+	if namespace := req.URL.Query().Get("namespace"); namespace != "" {
+		pod.Namespace = namespace
 	}
-	glog.Infof("Ready to write reponse ...")
-	if _, err := resp.Write(result); err != nil {
+	if pod.Namespace == "" {
+		pod.Namespace = GetMeshConfig().AppNamespace
+	}
+	var decision *InjectionDecision
+	if injected := alreadyInjected(&pod); injected != "" {
+		decision = &InjectionDecision{false, "pod is already injected: " + injected}
+	} else {
+		decision = server.decideInjection(NewPodInfo(&pod))
+	}
+	resp.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(resp).Encode(decision); err != nil {
 		glog.Errorf("Can't write response: %v", err)
-		http.Error(resp, fmt.Sprintf("could not write response: %v", err), http.StatusInternalServerError)
 	}
 }
 
+// admitFunc answers an AdmissionReview request, it is shared by /mutate and /validate.
+type admitFunc func(*v1beta1.AdmissionReview) *v1beta1.AdmissionResponse
+
+func denied(message string) *v1beta1.AdmissionResponse {
+	return &v1beta1.AdmissionResponse{
+		Allowed: false,
+		Result: &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Reason:  metav1.StatusReasonInvalid,
+			Message: message,
+		},
+	}
+}
+
+// Validate rejects pods with malformed mesh annotations and invalid mesh custom resources.
+func (server *WebhookServer) Validate(ar *v1beta1.AdmissionReview) *v1beta1.AdmissionResponse {
+	req := ar.Request
+
+	glog.Infof("Validate Kind=%v, Namespace=%v Name=%v Operation=%v",
+		req.Kind, req.Namespace, req.Name, req.Operation)
+	if req.Operation == v1beta1.Delete {
+		return &v1beta1.AdmissionResponse{Allowed: true}
+	}
+
+	var err error
+	switch req.Kind.Kind {
+	case "Pod":
+		var pod, oldPod corev1.Pod
+		if err := json.Unmarshal(req.Object.Raw, &pod); err != nil {
+			return denied(err.Error())
+		}
+		if len(req.OldObject.Raw) > 0 {
+			if err := json.Unmarshal(req.OldObject.Raw, &oldPod); err != nil {
+				return denied(err.Error())
+			}
+		}
+		if errs := ValidateAnnotations(pod.Annotations, oldPod.Annotations); len(errs) > 0 {
+			sort.Strings(errs)
+			err = fmt.Errorf("invalid annotations: %s", strings.Join(errs, "; "))
+		}
+	case TRAFFIC_SPLIT_KIND:
+		var split TrafficSplit
+		if err = json.Unmarshal(req.Object.Raw, &split); err == nil {
+			if split.Namespace == "" {
+				split.Namespace = req.Namespace
+			}
+			err = NewTrafficSplitInfo(&split).Validate()
+		}
+	case SERVICE_ENTRY_KIND:
+		var entry ServiceEntry
+		if err = json.Unmarshal(req.Object.Raw, &entry); err == nil {
+			err = NewServiceEntryInfo(&entry).Validate()
+		}
+	case CANARY_KIND:
+		var canary Canary
+		if err = json.Unmarshal(req.Object.Raw, &canary); err == nil {
+			err = canary.Validate()
+		}
+	}
+	if err != nil {
+		message := fmt.Sprintf("%s %s@%s: %s", req.Kind.Kind, req.Name, req.Namespace, err.Error())
+		glog.Warningf("Denied %s", message)
+		return denied(message)
+	}
+	return &v1beta1.AdmissionResponse{Allowed: true}
+}
+
+func (server *WebhookServer) serveAdmission(admit admitFunc) http.HandlerFunc {
+	return func(resp http.ResponseWriter, req *http.Request) {
+		var body []byte
+		if req.Body != nil {
+			if data, err := ioutil.ReadAll(req.Body); err == nil {
+				body = data
+			}
+		}
+		if len(body) == 0 {
+			http.Error(resp, "empty body", http.StatusBadRequest)
+			return
+		}
+
+		// verify the content type is accurate
+		contentType := req.Header.Get("Content-Type")
+		if contentType != "application/json" {
+			glog.Errorf("Content-Type=%s, expect application/json", contentType)
+			http.Error(resp, "invalid Content-Type, expect `application/json`", http.StatusUnsupportedMediaType)
+			return
+		}
+
+		var admissionResponse *v1beta1.AdmissionResponse
+		ar := v1beta1.AdmissionReview{}
+		if _, _, err := deserializer.Decode(body, nil, &ar); err != nil {
+			glog.Errorf("Can't decode body: %v", err)
+			admissionResponse = &v1beta1.AdmissionResponse{
+				Result: &metav1.Status{
+					Message: err.Error(),
+				},
+			}
+		} else {
+			admissionResponse = admit(&ar)
+		}
+
+		//admission.k8s.io/v1 and v1beta1 share the same schema, answer with the version of the request
+		admissionReview := v1beta1.AdmissionReview{
+			TypeMeta: metav1.TypeMeta{
+				APIVersion: ADMISSION_REVIEW_V1BETA1,
+				Kind:       ADMISSION_REVIEW_KIND,
+			},
+		}
+		if ar.APIVersion == ADMISSION_REVIEW_V1 {
+			admissionReview.APIVersion = ADMISSION_REVIEW_V1
+		}
+		if admissionResponse != nil {
+			admissionReview.Response = admissionResponse
+			if ar.Request != nil {
+				admissionReview.Response.UID = ar.Request.UID
+			}
+		}
+
+		result, err := json.Marshal(admissionReview)
+		if err != nil {
+			glog.Errorf("Can't encode response: %v", err)
+			http.Error(resp, fmt.Sprintf("could not encode response: %v", err), http.StatusInternalServerError)
+			return
+		}
+		glog.Infof("Ready to write reponse ...")
+		if _, err := resp.Write(result); err != nil {
+			glog.Errorf("Can't write response: %v", err)
+			http.Error(resp, fmt.Sprintf("could not write response: %v", err), http.StatusInternalServerError)
+		}
+	}
+}
+
+func (server *WebhookServer) WatchSidecarTemplate(stopper chan struct{}) {
+	server.sidecarTemplate.Watch(stopper, server.k8sManager)
+}
+
+func (server *WebhookServer) RotateCertificates(stopper chan struct{}) {
+	server.certManager.Run(stopper)
+}
+
 func (server *WebhookServer) Run() {
 	mux := http.NewServeMux()
-	mux.HandleFunc("/mutate", server.Process)
+	mux.HandleFunc("/mutate", server.serveAdmission(server.Mutate))
+	mux.HandleFunc("/validate", server.serveAdmission(server.Validate))
+	mux.HandleFunc("/explain", server.Explain)
 	server.server.Handler = mux
 
 	glog.Infof("Starting Webhook Server ...")